@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"muhq.space/go/wrms/llog"
+)
+
+const (
+	DEFAULT_VOLUME = 100
+	MAX_VOLUME     = 100
+)
+
+var ErrUnknownPreset = errors.New("unknown audio filter preset")
+
+// Change the playback volume in percent and tell all clients
+func (wrms *Wrms) SetVolume(volume int) error {
+	if volume < 0 || volume > MAX_VOLUME {
+		return fmt.Errorf("invalid volume %d: must be between 0 and %d", volume, MAX_VOLUME)
+	}
+
+	// Do not block the rwlock while the player applies the volume
+	if err := wrms.Player.SetVolume(volume); err != nil {
+		return err
+	}
+
+	wrms.rwlock.Lock()
+	wrms.volume = volume
+	ev := wrms.newEvent("volume", nil)
+	ev.Volume = &volume
+	wrms.rwlock.Unlock()
+
+	llog.Info("Set the volume to %d%%", volume)
+	wrms.Broadcast(ev)
+	return nil
+}
+
+// Jump to the position in seconds of the current song
+func (wrms *Wrms) Seek(position float64) error {
+	wrms.rwlock.RLock()
+	song := wrms.CurrentSong.Load()
+	started := !wrms.startedAt.IsZero()
+	wrms.rwlock.RUnlock()
+
+	if song == nil || !started {
+		return ErrNotPlaying
+	}
+
+	if position < 0 || (song.Duration > 0 && position > song.Duration) {
+		return fmt.Errorf("invalid position %v of %v", position, song)
+	}
+
+	if err := wrms.Player.Seek(position); err != nil {
+		return err
+	}
+
+	wrms.rwlock.Lock()
+	// The song changed while seeking
+	if wrms.CurrentSong.Load() != song || wrms.startedAt.IsZero() {
+		wrms.rwlock.Unlock()
+		return nil
+	}
+
+	offset := time.Duration(position * float64(time.Second))
+	if wrms.pausedAt.IsZero() {
+		wrms.startedAt = time.Now().Add(-offset)
+	} else {
+		wrms.startedAt = wrms.pausedAt.Add(-offset)
+	}
+
+	ev := wrms.newEvent("progress", []*Song{song})
+	wrms._addProgress(&ev)
+	wrms.rwlock.Unlock()
+
+	wrms.Broadcast(ev)
+	return nil
+}
+
+// Return the names of the configured audio filter presets
+func (wrms *Wrms) audioFilterPresets() []string {
+	presets := maps.Keys(wrms.Config.AudioFilters)
+	slices.Sort(presets)
+	return presets
+}
+
+// Apply a configured audio filter preset or remove the active one if preset is empty
+func (wrms *Wrms) SetAudioFilter(preset string) error {
+	filter, ok := wrms.Config.AudioFilters[preset]
+	if preset != "" && !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownPreset, preset)
+	}
+
+	if err := wrms.Player.SetAudioFilter(filter); err != nil {
+		return err
+	}
+
+	wrms.rwlock.Lock()
+	wrms.audioFilter = preset
+	ev := wrms.newEvent("filter", nil)
+	ev.Filter = preset
+	wrms.rwlock.Unlock()
+
+	llog.Info("Set the audio filter preset to '%s'", preset)
+	wrms.Broadcast(ev)
+	return nil
+}
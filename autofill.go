@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+
+	"muhq.space/go/wrms/llog"
+)
+
+// Sources for songs played when the queue runs empty
+const (
+	AUTOFILL_HISTORY = "history"
+	AUTOFILL_LOCAL   = "local"
+	AUTOFILL_RELATED = "related"
+)
+
+// Pick a song to play because the queue is empty.
+// The sources in Config.Autofill are tried in order.
+// The rwlock must be held when calling _autofill.
+func (wrms *Wrms) _autofill() *Song {
+	last := wrms.CurrentSong.Load()
+
+	for _, source := range wrms.Config.Autofill {
+		var candidates []*Song
+		switch source {
+		case AUTOFILL_HISTORY:
+			for _, entry := range wrms.History {
+				if !entry.Skipped {
+					candidates = append(candidates, entry.Song)
+				}
+			}
+		case AUTOFILL_LOCAL:
+			if s := wrms.Player.RandomSong("local"); s != nil {
+				candidates = append(candidates, s)
+			}
+		case AUTOFILL_RELATED:
+			candidates = wrms.relatedSongs
+		default:
+			llog.Error("Unknown autofill source %s", source)
+			continue
+		}
+
+		// Do not repeat the song that just finished or play banned songs
+		filtered := make([]*Song, 0, len(candidates))
+		for _, s := range candidates {
+			if (last == nil || s.Key() != last.Key()) && wrms._checkBanned(s) == nil {
+				filtered = append(filtered, s)
+			}
+		}
+
+		if len(filtered) == 0 {
+			continue
+		}
+
+		picked := filtered[rand.Intn(len(filtered))]
+		song := NewDetailedSong(picked.Title, picked.Artist, picked.Source, picked.Uri,
+			picked.Album, picked.Year)
+		song.Duration = picked.Duration
+		song.Autofill = source
+		llog.Info("Autofill picked %v from %s", song, source)
+		return song
+	}
+
+	return nil
+}
+
+// Search songs related to the song that started playing in the background
+// to use them as autofill candidates.
+func (wrms *Wrms) findRelatedSongs(song *Song) {
+	if song.Artist == "" {
+		return
+	}
+
+	var related []*Song
+	for results := range wrms.Player.Search(map[string]string{"artist": song.Artist}) {
+		related = append(related, results...)
+	}
+
+	llog.Debug("Found %d songs related to %v", len(related), song)
+	wrms.rwlock.Lock()
+	wrms.relatedSongs = related
+	wrms.rwlock.Unlock()
+}
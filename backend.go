@@ -3,18 +3,69 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"sync"
 )
 
 type Backend interface {
-	Play(song *Song, player Player)
+	// Hand the song to the player or report why it can not be played
+	Play(song *Song, player Player) error
 	Search(map[string]string) []*Song
 	OnSongFinished(song *Song)
 }
 
+// Backends able to pick random songs from their library for the autofill
+type RandomSongProvider interface {
+	RandomSong() *Song
+}
+
+// Backends able to look up the duration of their songs
+type DurationProvider interface {
+	// Return the duration of the song in seconds or 0 if it is unknown
+	Duration(song *Song) (float64, error)
+}
+
+// Backends able to prepare a song before it is played to shorten the gap before it.
+// Prefetch is called with the rwlock held and must not block.
+type Prefetcher interface {
+	Prefetch(song *Song)
+	// Release everything prefetched for a song which will not be played next
+	Discard(song *Song)
+}
+
+// Backends shared by all rooms using the same backend configuration.
+// Backends keep no state of a room because they play the songs on the player passed to Play
+// and key their prefetched data by the song. Sharing them avoids a second spotify login
+// and a second scan of the local music directory per room.
+// The upload backend is never shared because it adds the uploaded songs to its room.
+type backendPool struct {
+	lock     sync.Mutex
+	backends map[string]Backend
+}
+
+var sharedBackends = backendPool{backends: map[string]Backend{}}
+
+// Return the backend created for key or create it.
+// Backends whose creation failed are not remembered to retry them for the next room.
+func (pool *backendPool) get(key string, create func() (Backend, error)) (Backend, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if b, ok := pool.backends[key]; ok {
+		return b, nil
+	}
+
+	b, err := create()
+	if err != nil {
+		return nil, err
+	}
+	pool.backends[key] = b
+	return b, nil
+}
+
 type DummyBackend struct{}
 
-func (dummy *DummyBackend) Play(song *Song, player Player) {}
-func (dummy *DummyBackend) OnSongFinished(song *Song)      {}
+func (dummy *DummyBackend) Play(song *Song, player Player) error { return nil }
+func (dummy *DummyBackend) OnSongFinished(song *Song)            {}
 func (dummy *DummyBackend) Search(map[string]string) []*Song {
 	s := NewDummySong("Dummy Mc Crashtest", "foo")
 	return []*Song{s}
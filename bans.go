@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"golang.org/x/exp/slices"
+	"muhq.space/go/wrms/llog"
+)
+
+// Kinds of ban list entries
+const (
+	BAN_SONG    = "song"
+	BAN_ARTIST  = "artist"
+	BAN_PATTERN = "pattern"
+)
+
+var ErrBanned = errors.New("song is banned")
+
+// Songs that must never be played
+type BanList struct {
+	// Canonical song identifiers: <source>:<uri>
+	Songs   []string `yaml:"songs,omitempty" json:"songs"`
+	Artists []string `yaml:"artists,omitempty" json:"artists"`
+	// Regular expressions matched against the title and the artist
+	Patterns []string `yaml:"patterns,omitempty" json:"patterns"`
+	compiled []*regexp.Regexp
+}
+
+func (bans BanList) clone() BanList {
+	return BanList{
+		Songs:    slices.Clone(bans.Songs),
+		Artists:  slices.Clone(bans.Artists),
+		Patterns: slices.Clone(bans.Patterns),
+	}
+}
+
+func (bans *BanList) compile() {
+	bans.compiled = nil
+	for _, pattern := range bans.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			llog.Error("Ignoring invalid ban pattern %s: %v", pattern, err)
+			continue
+		}
+		bans.compiled = append(bans.compiled, re)
+	}
+}
+
+// Return the reason why the song is banned or an empty string
+func (bans *BanList) Match(s *Song) string {
+	if slices.Contains(bans.Songs, s.Key()) {
+		return "the song is banned"
+	}
+
+	artist, _ := s.normalizedArtistTitle()
+	for _, banned := range bans.Artists {
+		if b := fold(banned); b != "" && (b == fold(s.Artist) || b == artist) {
+			return fmt.Sprintf("the artist %s is banned", banned)
+		}
+	}
+
+	for _, re := range bans.compiled {
+		if re.MatchString(s.Title) || re.MatchString(s.Artist) {
+			return fmt.Sprintf("it matches the banned pattern %s", re)
+		}
+	}
+
+	return ""
+}
+
+func (bans *BanList) entries(kind string) (*[]string, error) {
+	switch kind {
+	case BAN_SONG:
+		return &bans.Songs, nil
+	case BAN_ARTIST:
+		return &bans.Artists, nil
+	case BAN_PATTERN:
+		return &bans.Patterns, nil
+	}
+	return nil, fmt.Errorf("unknown ban kind %s", kind)
+}
+
+func (bans *BanList) Add(kind, entry string) error {
+	entries, err := bans.entries(kind)
+	if err != nil {
+		return err
+	}
+
+	if kind == BAN_PATTERN {
+		if _, err := regexp.Compile(entry); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", entry, err)
+		}
+	}
+
+	if !slices.Contains(*entries, entry) {
+		*entries = append(*entries, entry)
+	}
+	bans.compile()
+	return nil
+}
+
+func (bans *BanList) Remove(kind, entry string) error {
+	entries, err := bans.entries(kind)
+	if err != nil {
+		return err
+	}
+
+	i := slices.Index(*entries, entry)
+	if i < 0 {
+		return fmt.Errorf("%s %s is not banned", kind, entry)
+	}
+
+	*entries = slices.Delete(*entries, i, i+1)
+	bans.compile()
+	return nil
+}
+
+// Return the reason if the song is banned.
+// The rwlock must be held when calling _checkBanned.
+func (wrms *Wrms) _checkBanned(song *Song) error {
+	if reason := wrms.Config.Bans.Match(song); reason != "" {
+		return fmt.Errorf("%w: %s", ErrBanned, reason)
+	}
+	return nil
+}
+
+// Drop banned songs from the streamed search results
+func (wrms *Wrms) filterBanned(in chan []*Song) chan []*Song {
+	out := make(chan []*Song)
+
+	go func() {
+		for results := range in {
+			allowed := make([]*Song, 0, len(results))
+			wrms.rwlock.RLock()
+			for _, s := range results {
+				if wrms._checkBanned(s) == nil {
+					allowed = append(allowed, s)
+				}
+			}
+			wrms.rwlock.RUnlock()
+			out <- allowed
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// Add or remove a ban list entry, persist the ban list and
+// remove all newly banned songs from the queue
+func (wrms *Wrms) UpdateBans(kind, entry string, ban bool) error {
+	wrms.rwlock.Lock()
+
+	var err error
+	if ban {
+		err = wrms.Config.Bans.Add(kind, entry)
+	} else {
+		err = wrms.Config.Bans.Remove(kind, entry)
+	}
+
+	if err != nil {
+		wrms.rwlock.Unlock()
+		return err
+	}
+
+	if err := wrms.Config.saveBans(wrms.Name); err != nil {
+		llog.Error("Persisting the ban list failed: %v", err)
+	}
+
+	var banned []*Song
+	for _, s := range wrms.Songs {
+		if wrms._checkBanned(s) != nil {
+			banned = append(banned, s)
+		}
+	}
+
+	if len(banned) == 0 {
+		wrms.rwlock.Unlock()
+		return nil
+	}
+
+	for _, s := range banned {
+		llog.Info("Removing banned song %v from the queue", s)
+		i := slices.Index(wrms.Songs, s)
+		wrms.Songs = slices.Delete(wrms.Songs, i, i+1)
+		wrms.queue.RemoveSong(s)
+	}
+
+	wrms.saveState()
+	ev := wrms.newEvent("delete", banned)
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
+
+	wrms.Broadcast(ev)
+	return nil
+}
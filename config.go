@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/exp/slices"
@@ -23,11 +27,55 @@ type Config struct {
 	Admins        []uuid.UUID    `yaml:"admins"`
 	Spotify       *SpotifyConfig `yaml:"spotify"`
 	TimeBonus     float64        `yaml:"time-bonus"`
-	HasUpload     bool
+	// "add": grant TimeBonus to all queued songs on each added song
+	// "continuous": grant TimeBonus per minute a song waits in the queue
+	TimeBonusMode string `yaml:"time-bonus-mode"`
+	// Seconds between updates of the continuous time bonus
+	TimeBonusInterval int `yaml:"time-bonus-interval"`
+	// Seconds between broadcasts of the playback progress, 0 disables them
+	ProgressInterval int    `yaml:"progress-interval"`
+	Ranking          string `yaml:"ranking"`
+	// Ordering of the queue: vote or fair
+	QueueMode string `yaml:"queue-mode"`
+	StateFile string `yaml:"state-file"`
+	// Votes needed to skip the current song.
+	// Values below 1 are a fraction of the connected clients and 0 disables skip votes.
+	SkipThreshold float64 `yaml:"skip-threshold"`
+	// Sources tried in order to pick a song when the queue is empty
+	Autofill []string `yaml:"autofill"`
+	// Playlist played when the queue is empty
+	Fallback *FallbackConfig `yaml:"fallback"`
+	Limits   LimitsConfig    `yaml:"limits"`
+	// Seconds after playing a song before it can be added again
+	ReplayWindow int `yaml:"replay-window"`
+	// Maximum duration of added songs in seconds, songs of unknown duration are rejected if set
+	MaxDuration int `yaml:"max-duration"`
+	// Handling of the same track added from another source: warn or merge
+	CrossSourceDuplicates string `yaml:"cross-source-duplicates"`
+	// Queue the same song multiple times as separate entries
+	AllowDuplicates bool `yaml:"allow-duplicates"`
+	// Songs, artists and patterns never played.
+	// The top-level ban list is inherited by all rooms without their own ban list.
+	Bans BanList `yaml:"bans"`
+	// Seconds the end of a song overlaps with the start of the next song, 0 disables crossfading
+	Crossfade float64 `yaml:"crossfade"`
+	// Initial playback volume in percent
+	Volume int `yaml:"volume"`
+	// Named mpv audio filter chains admins can apply
+	AudioFilters map[string]string `yaml:"audio-filters"`
+	// Room specific configurations overriding the values above
+	Rooms     map[string]yaml.Node `yaml:"rooms"`
+	HasUpload bool
+	// The config file the configuration was loaded from
+	path string
 }
 
 func defaultConfig() Config {
-	c := Config{Port: 8080, UploadDir: "uploads", LogLevel: "Info"}
+	c := Config{Port: 8080, UploadDir: "uploads", LogLevel: "Info",
+		TimeBonusMode:     TIME_BONUS_ON_ADD,
+		TimeBonusInterval: int(DEFAULT_TIME_BONUS_INTERVAL / time.Second),
+		ProgressInterval:  int(DEFAULT_PROGRESS_INTERVAL / time.Second),
+		Volume:            DEFAULT_VOLUME}
 	return c
 }
 
@@ -35,6 +83,43 @@ func (c Config) IsAdmin(id uuid.UUID) bool {
 	return slices.Contains(c.Admins, id)
 }
 
+// Derive the configuration of a room from c and the room's own configuration.
+// Queues, admins and files are never shared between rooms.
+func (c Config) roomConfig(name string, node yaml.Node) (Config, error) {
+	rc := c
+	rc.Rooms = nil
+	rc.Admins = nil
+	rc.Playlists = nil
+	rc.Backends = slices.Clone(c.Backends)
+	rc.Bans = c.Bans.clone()
+
+	// Rooms created at runtime have no configuration
+	if node.Kind != 0 {
+		// The ban list of a room replaces the inherited one instead of being merged into it
+		if yamlMapValue(&node, "bans") != nil {
+			rc.Bans = BanList{}
+		}
+
+		if err := node.Decode(&rc); err != nil {
+			return rc, err
+		}
+	}
+
+	if name != DEFAULT_ROOM {
+		if rc.StateFile != "" && rc.StateFile == c.StateFile {
+			ext := path.Ext(c.StateFile)
+			rc.StateFile = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(c.StateFile, ext), name, ext)
+		}
+
+		if rc.UploadDir == c.UploadDir {
+			rc.UploadDir = path.Join(c.UploadDir, name)
+		}
+	}
+
+	rc.HasUpload = slices.Contains(rc.Backends, "upload")
+	return rc, nil
+}
+
 func findConfig() string {
 	confDir := os.Getenv("XDG_CONFIG_DIR")
 	if confDir == "" {
@@ -72,6 +157,7 @@ func loadConfig(configPath string) Config {
 		llog.Fatal("Failed to parse config %s: %v", configPath, err)
 	}
 
+	config.path = configPath
 	return config
 }
 
@@ -83,3 +169,132 @@ func newConfig() Config {
 
 	return defaultConfig()
 }
+
+// Serialize writes of the config file by multiple rooms
+var configFileLock sync.Mutex
+
+// Return the value node of key in the mapping node or nil
+func yamlMapValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Replace or add the value node of key in the mapping node
+func yamlMapSet(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	mapping.Content = append(mapping.Content, keyNode, value)
+}
+
+// Store the ban list of a room in its section of the config file it was loaded from.
+// The top-level ban list is only the template inherited by all rooms and is never changed.
+// Rooms created at runtime have no section and their ban list is not persisted to not
+// make them permanent.
+func (c *Config) saveBans(room string) error {
+	if c.path == "" {
+		llog.Warning("Not persisting the ban list without a config file")
+		return nil
+	}
+
+	configFileLock.Lock()
+	defer configFileLock.Unlock()
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	section := doc.Content[0]
+	if section.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s is not a mapping", c.path)
+	}
+
+	rooms := yamlMapValue(section, "rooms")
+	var roomSection *yaml.Node
+	if rooms != nil {
+		roomSection = yamlMapValue(rooms, room)
+	}
+
+	// The default room always exists -> adding its section does not create a room
+	if roomSection == nil && room == DEFAULT_ROOM {
+		if rooms == nil {
+			rooms = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			yamlMapSet(section, "rooms", rooms)
+		}
+
+		roomSection = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		yamlMapSet(rooms, room, roomSection)
+	}
+
+	if roomSection == nil {
+		llog.Warning("Not persisting the ban list of room %s created at runtime", room)
+		return nil
+	}
+
+	// An empty room section is a null value
+	if roomSection.Kind != yaml.MappingNode {
+		*roomSection = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+
+	var bans yaml.Node
+	if err := bans.Encode(c.Bans); err != nil {
+		return err
+	}
+	yamlMapSet(roomSection, "bans", &bans)
+
+	var sb strings.Builder
+	enc := yaml.NewEncoder(&sb)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+
+	// Never leave a partially written config behind
+	tmp, err := os.CreateTemp(path.Dir(c.path), ".wrms-config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(info.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
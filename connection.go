@@ -67,6 +67,12 @@ func (c *Connection) Send(ev Event) {
 	c.refs.Add(-1)
 }
 
+// Send a private event through the ordered channel.
+// Private events have no id and are sent as soon as they are received.
+func (c *Connection) SendPrivate(event string, songs []*Song) {
+	c.Send(c.wrms.newPrivateEvent(0, event, songs))
+}
+
 func (conn *Connection) _send(evs []interface{}) {
 	for _, ev := range evs {
 		data, err := json.Marshal(ev)
@@ -123,7 +129,7 @@ func (conn *Connection) serve() {
 func (c *Connection) Close() {
 	llog.Info("Closing connection %s", c.Id)
 	// Remove the closing connection from the map
-	wrms.delConn(c)
+	c.wrms.delConn(c)
 	// Announce that the connection is going to be closed
 	c.closing.Store(true)
 
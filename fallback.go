@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+
+	"golang.org/x/exp/slices"
+	"muhq.space/go/wrms/llog"
+)
+
+// Autofill marker of songs from the fallback playlist
+const FALLBACK = "fallback"
+
+type FallbackConfig struct {
+	Playlists []string `yaml:"playlists" json:"playlists"`
+	Shuffle   bool     `yaml:"shuffle" json:"shuffle"`
+	Repeat    bool     `yaml:"repeat" json:"repeat"`
+}
+
+// The fallback playlist is played when the voted queue is empty
+type FallbackPlaylist struct {
+	Config FallbackConfig
+	songs  []*Song
+	// Songs not played yet during the current pass through the playlist
+	pending []*Song
+}
+
+func (wrms *Wrms) loadFallback(config FallbackConfig) *FallbackPlaylist {
+	fb := &FallbackPlaylist{Config: config}
+	for _, playlist := range config.Playlists {
+		fb.songs = append(fb.songs, wrms.Player.LoadPlaylist(playlist)...)
+	}
+
+	llog.Info("Loaded %d songs into the fallback playlist", len(fb.songs))
+	fb.refill()
+	return fb
+}
+
+func (fb *FallbackPlaylist) refill() {
+	fb.pending = slices.Clone(fb.songs)
+	if fb.Config.Shuffle {
+		rand.Shuffle(len(fb.pending), func(i, j int) {
+			fb.pending[i], fb.pending[j] = fb.pending[j], fb.pending[i]
+		})
+	}
+}
+
+func (fb *FallbackPlaylist) Next() *Song {
+	if len(fb.pending) == 0 {
+		if !fb.Config.Repeat {
+			return nil
+		}
+		fb.refill()
+	}
+
+	if len(fb.pending) == 0 {
+		return nil
+	}
+
+	next := fb.pending[0]
+	fb.pending = fb.pending[1:]
+
+	// Return a fresh song to not share the votes between multiple passes
+	song := NewDetailedSong(next.Title, next.Artist, next.Source, next.Uri, next.Album, next.Year)
+	song.Duration = next.Duration
+	song.Autofill = FALLBACK
+	return song
+}
+
+// Replace the fallback playlist at runtime
+func (wrms *Wrms) SetFallback(config FallbackConfig) {
+	// Loading playlists may take a while -> do not block the rwlock
+	fb := wrms.loadFallback(config)
+
+	wrms.rwlock.Lock()
+	wrms.fallback = fb
+	wrms.rwlock.Unlock()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"muhq.space/go/wrms/llog"
+)
+
+const (
+	// Consecutive failed plays after which a backend is not used for a while
+	BACKEND_FAILURES_BEFORE_UNHEALTHY = 3
+	BACKEND_RECOVERY_TIME             = 5 * time.Minute
+	// Consecutive failed plays after which the playback is paused instead of
+	// burning through the queue, the fallback playlist or the autofill
+	MAX_FAILED_PLAYS = 10
+)
+
+var ErrBackendUnhealthy = errors.New("backend is unhealthy")
+
+type backendHealth struct {
+	failures int
+	// The backend is not used before retryAt
+	retryAt time.Time
+}
+
+// Report if the backend is temporarily not used because it failed repeatedly.
+// The rwlock must be held when calling _checkBackendHealth.
+func (wrms *Wrms) _checkBackendHealth(source string) error {
+	if h := wrms.backendHealth[source]; h != nil && time.Now().Before(h.retryAt) {
+		return fmt.Errorf("%w: %s is not used until %s",
+			ErrBackendUnhealthy, source, h.retryAt.Format(time.Kitchen))
+	}
+	return nil
+}
+
+// Report if the song's backend is currently used.
+// The rwlock must be held when calling _playable.
+func (wrms *Wrms) _playable(song *Song) bool {
+	return wrms._checkBackendHealth(song.Source) == nil
+}
+
+// Track the consecutive failed plays of a backend and mark it unhealthy if it keeps failing.
+// The rwlock must be held when calling _recordPlay.
+func (wrms *Wrms) _recordPlay(source string, err error) {
+	if err == nil {
+		delete(wrms.backendHealth, source)
+		return
+	}
+
+	if wrms.backendHealth == nil {
+		wrms.backendHealth = map[string]*backendHealth{}
+	}
+
+	h := wrms.backendHealth[source]
+	if h == nil {
+		h = &backendHealth{}
+		wrms.backendHealth[source] = h
+	}
+
+	h.failures++
+	if h.failures < BACKEND_FAILURES_BEFORE_UNHEALTHY {
+		return
+	}
+
+	h.retryAt = time.Now().Add(BACKEND_RECOVERY_TIME)
+	reason := fmt.Errorf("the %s backend failed to play %d songs in a row: not using it for %v",
+		source, h.failures, BACKEND_RECOVERY_TIME)
+	h.failures = 0
+
+	llog.Error("%v", reason)
+	wrms._notifyAdmins(wrms.newPlayerErrorEvent(reason))
+	time.AfterFunc(BACKEND_RECOVERY_TIME, func() { wrms.backendRecovered(source) })
+}
+
+// Continue with the songs of a backend which were kept queued while it was unhealthy
+func (wrms *Wrms) backendRecovered(source string) {
+	wrms.rwlock.Lock()
+	llog.Info("Using the %s backend again", source)
+
+	if wrms.playing && wrms.CurrentSong.Load() == nil {
+		// _next() releases the rwlock
+		wrms._next()
+		return
+	}
+
+	wrms._prefetchNext()
+	wrms.unlock()
+}
+
+// Record a song which could not be played as skipped and tell the clients why.
+// The playback is paused if too many songs failed to play in a row.
+// The rwlock must be held when calling _playFailed.
+func (wrms *Wrms) _playFailed(song *Song, err error) {
+	llog.Error("Playing %v failed: %v", song, err)
+	ev := wrms.newEvent("playfailed", []*Song{song})
+	ev.Reason = err.Error()
+	wrms._broadcast(ev)
+
+	wrms._endPlay(true)
+
+	wrms.failedPlays++
+	if wrms.failedPlays < MAX_FAILED_PLAYS {
+		return
+	}
+
+	reason := fmt.Errorf("%d songs failed to play in a row: pausing the playback", wrms.failedPlays)
+	llog.Error("%v", reason)
+	wrms.failedPlays = 0
+	wrms.playing = false
+	wrms._broadcast(wrms.newNotification("pause"))
+	wrms._notifyAdmins(wrms.newPlayerErrorEvent(reason))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"muhq.space/go/wrms/llog"
+)
+
+// Number of history entries sent to newly connected clients
+const RECENT_HISTORY_SIZE = 10
+
+type HistoryEntry struct {
+	Song      *Song     `json:"song"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	Skipped   bool      `json:"skipped"`
+	Weight    float64   `json:"weight"`
+	Upvotes   int       `json:"upvotes"`
+	Downvotes int       `json:"downvotes"`
+}
+
+// Start playing a song and open a new history entry for it.
+// A song failing to play is recorded as well to be closed as skipped.
+// The rwlock must be held when calling _play.
+func (wrms *Wrms) _play(song *Song) error {
+	err := wrms._checkBackendHealth(song.Source)
+	if err == nil {
+		err = wrms.Player.Play(song)
+		wrms._recordPlay(song.Source, err)
+	}
+
+	if err == nil {
+		wrms.failedPlays = 0
+		wrms._startProgress()
+	}
+
+	// The song was only paused and is already recorded
+	if wrms.playEntry != nil && wrms.playEntry.Song == song {
+		return err
+	}
+
+	wrms.playEntry = &HistoryEntry{Song: song, Started: time.Now()}
+
+	if err == nil && slices.Contains(wrms.Config.Autofill, AUTOFILL_RELATED) {
+		go wrms.findRelatedSongs(song)
+	}
+	return err
+}
+
+// Close the history entry of the current song and broadcast it.
+// The rwlock must be held when calling _endPlay.
+func (wrms *Wrms) _endPlay(skipped bool) {
+	wrms._stopProgress()
+
+	entry := wrms.playEntry
+	if entry == nil {
+		return
+	}
+	wrms.playEntry = nil
+
+	entry.Ended = time.Now()
+	entry.Skipped = skipped
+	entry.Weight = entry.Song.Weight
+	entry.Upvotes = len(entry.Song.Upvotes)
+	entry.Downvotes = len(entry.Song.Downvotes)
+
+	wrms.History = append(wrms.History, entry)
+	llog.Info("Recorded %v in the play history", entry)
+
+	ev := wrms.newEvent("history", nil)
+	ev.History = []*HistoryEntry{entry}
+	wrms._broadcast(ev)
+}
+
+// Return the requested page of the history with the most recently played songs first.
+// The rwlock must be held when calling _historyPage.
+func (wrms *Wrms) _historyPage(page, size int) []*HistoryEntry {
+	entries := []*HistoryEntry{}
+	if page < 0 || size <= 0 {
+		return entries
+	}
+
+	// Compare by division because page*size may overflow
+	pages := len(wrms.History) / size
+	if len(wrms.History)%size != 0 {
+		pages++
+	}
+	if page >= pages {
+		return entries
+	}
+
+	for i := len(wrms.History) - 1 - page*size; i >= 0 && len(entries) < size; i-- {
+		entries = append(entries, wrms.History[i])
+	}
+	return entries
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// How songs from different sources, which are the same track, are handled by AddSong
+const (
+	CROSS_SOURCE_IGNORE = ""
+	CROSS_SOURCE_WARN   = "warn"
+	CROSS_SOURCE_MERGE  = "merge"
+)
+
+var (
+	// Parenthesized decorations added by video platforms and re-releases
+	titleNoise = regexp.MustCompile(`(?i)\s*[(\[][^)\]]*\b(official|video|audio|lyrics?|visuali[sz]er|remaster(ed)?|hd|hq|explicit)\b[^)\]]*[)\]]`)
+	// Featured artists in titles like "Song (feat. Other)" or "Song ft. Other"
+	titleFeat = regexp.MustCompile(`(?i)\s*[(\[]?\s*\b(feat\.?|ft\.|featuring)\s.*$`)
+	// Separators between multiple artists
+	artistSeparator = regexp.MustCompile(`(?i)\s*(,|&|;|/|\bfeat\.?|\bft\.|\bfeaturing\b|\bx\b)\s*`)
+
+	accentFolder = strings.NewReplacer(
+		"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+		"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+		"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+		"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+		"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+	)
+)
+
+// Fold a string to lower-case letters and digits without accents
+func fold(s string) string {
+	s = accentFolder.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// Return the artist and title of a song without featured artists and other noise.
+// Songs without an artist, like most youtube videos, are split at " - ".
+func (s *Song) normalizedArtistTitle() (string, string) {
+	artist, title := s.Artist, s.Title
+	if artist == "" {
+		if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+			artist, title = parts[0], parts[1]
+		}
+	}
+
+	title = titleNoise.ReplaceAllString(title, "")
+	title = titleFeat.ReplaceAllString(title, "")
+
+	// Only the main artist is reliably available from every source
+	artist = artistSeparator.Split(artist, 2)[0]
+
+	return fold(artist), fold(title)
+}
+
+// Return the identity of a song built from its normalized artist and title.
+// Songs without a title have no identity.
+func (s *Song) titleIdentity() string {
+	artist, title := s.normalizedArtistTitle()
+	if title == "" {
+		return ""
+	}
+	return artist + "|" + title
+}
+
+// Report if two songs are the same track possibly from different sources.
+// The ISRCs are only compared if both songs have one, which currently only
+// the songs loaded from Spotify playlists have.
+func (s *Song) SameTrack(other *Song) bool {
+	if s.Key() == other.Key() {
+		return true
+	}
+
+	if s.Isrc != "" && other.Isrc != "" {
+		return strings.EqualFold(s.Isrc, other.Isrc)
+	}
+
+	id := s.titleIdentity()
+	return id != "" && id == other.titleIdentity()
+}
+
+// Return the queued song from another source which is the same track.
+// The rwlock must be held when calling _findSameTrack.
+func (wrms *Wrms) _findSameTrack(song *Song) *Song {
+	for _, s := range wrms.Songs {
+		if s.Source != song.Source && s.SameTrack(song) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Collapse search results from different backends which are the same track.
+// The result received first is kept.
+func collapseSearchResults(in chan []*Song) chan []*Song {
+	out := make(chan []*Song)
+
+	go func() {
+		var kept []*Song
+		for results := range in {
+			collapsed := make([]*Song, 0, len(results))
+		out:
+			for _, s := range results {
+				for _, k := range kept {
+					if k.Source != s.Source && k.SameTrack(s) {
+						continue out
+					}
+				}
+				collapsed = append(collapsed, s)
+			}
+
+			kept = append(kept, collapsed...)
+			out <- collapsed
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// Warn the submitter that the same track is already queued from another source
+func (wrms *Wrms) notifyDuplicate(song, queued *Song) {
+	if conn := wrms.GetConn(song.AddedBy); conn != nil {
+		ev := wrms.newPrivateEvent(0, "duplicate", []*Song{song, queued})
+		ev.Reason = "the same track is already queued from " + queued.Source
+		conn.Send(ev)
+	}
+}
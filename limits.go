@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type LimitsConfig struct {
+	// Maximum number of songs a connection may have queued
+	QueuedPerConnection int `yaml:"queued-per-connection"`
+	// Maximum number of songs a connection may add during AddWindow seconds
+	Adds      int `yaml:"adds"`
+	AddWindow int `yaml:"add-window"`
+	// Maximum number of songs from each source a connection may have queued
+	PerSource map[string]int `yaml:"per-source"`
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Check if adding the song exceeds any configured limit.
+// Only songs added by clients are limited.
+// The rwlock must be held when calling _checkLimits.
+func (wrms *Wrms) _checkLimits(song *Song) error {
+	if song.AddedBy == uuid.Nil {
+		return nil
+	}
+
+	limits := wrms.Config.Limits
+	if limits.QueuedPerConnection > 0 {
+		if queued := len(wrms._songsAddedBy(song.AddedBy)); queued >= limits.QueuedPerConnection {
+			return fmt.Errorf("%w: you already have %d songs queued", ErrQuotaExceeded, queued)
+		}
+	}
+
+	if max, ok := limits.PerSource[song.Source]; ok {
+		queued := 0
+		for _, s := range wrms._songsAddedBy(song.AddedBy) {
+			if s.Source == song.Source {
+				queued++
+			}
+		}
+
+		if queued >= max {
+			return fmt.Errorf("%w: you already have %d %s songs queued",
+				ErrQuotaExceeded, queued, song.Source)
+		}
+	}
+
+	if limits.Adds > 0 && limits.AddWindow > 0 {
+		window := limits.addWindow()
+		adds := wrms._recentAdds(song.AddedBy)
+		if len(adds) >= limits.Adds {
+			wait := window - time.Since(adds[0])
+			return fmt.Errorf("%w: you can add your next song in %v",
+				ErrQuotaExceeded, wait.Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+// Check if adding the song exceeds any configured limit without adding it
+func (wrms *Wrms) checkLimits(song *Song) error {
+	wrms.rwlock.RLock()
+	defer wrms.rwlock.RUnlock()
+	return wrms._checkLimits(song)
+}
+
+func (limits LimitsConfig) addWindow() time.Duration {
+	return time.Duration(limits.AddWindow) * time.Second
+}
+
+// Return the adds of a connection within the add window.
+// The rwlock must be held when calling _recentAdds.
+func (wrms *Wrms) _recentAdds(connId uuid.UUID) []time.Time {
+	window := wrms.Config.Limits.addWindow()
+	adds := wrms.recentAdds[connId]
+	for len(adds) > 0 && time.Since(adds[0]) > window {
+		adds = adds[1:]
+	}
+	return adds
+}
+
+// The rwlock must be held when calling _recordAdd.
+func (wrms *Wrms) _recordAdd(song *Song) {
+	if song.AddedBy == uuid.Nil || wrms.Config.Limits.Adds <= 0 {
+		return
+	}
+
+	if wrms.recentAdds == nil {
+		wrms.recentAdds = map[uuid.UUID][]time.Time{}
+	}
+
+	wrms.recentAdds[song.AddedBy] = append(wrms._recentAdds(song.AddedBy), time.Now())
+}
+
+// Tell the submitter why its song was rejected
+func (wrms *Wrms) notifyRejected(song *Song, reason error) {
+	if conn := wrms.GetConn(song.AddedBy); conn != nil {
+		ev := wrms.newPrivateEvent(0, "rejected", []*Song{song})
+		ev.Reason = reason.Error()
+		conn.Send(ev)
+	}
+}
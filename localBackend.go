@@ -1,30 +1,41 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/dhowden/tag"
 	_ "github.com/mattn/go-sqlite3"
 	"muhq.space/go/wrms/llog"
 )
 
-const DB_URL = "file:songs?mode=memory&cache=shared"
+// Each backend instance uses its own in-memory database
+const DB_URL = "file:songs-%d?mode=memory&cache=shared"
+
+var nextDbId atomic.Uint64
 
 type LocalBackend struct {
 	musicDir string
 	db       *sql.DB
+	// Files opened while they wait at the top of the queue
+	opened *prefetchCache[*os.File]
 }
 
 func NewLocalBackend(musicDir string) *LocalBackend {
 	b := LocalBackend{musicDir: musicDir}
+	b.opened = newPrefetchCache(func(f *os.File) { f.Close() })
 
 	var err error
-	b.db, err = sql.Open("sqlite3", DB_URL)
+	b.db, err = sql.Open("sqlite3", fmt.Sprintf(DB_URL, nextDbId.Add(1)))
 	if err != nil {
 		llog.Fatal("Opening in-memory db failed: %q", err)
 	}
@@ -35,7 +46,8 @@ func NewLocalBackend(musicDir string) *LocalBackend {
 		Title text,
 		Artist text,
 		Album text,
-		Year int
+		Year int,
+		Duration real
 	);
 	`
 	_, err = b.db.Exec(sqlStmt)
@@ -56,14 +68,14 @@ func (b *LocalBackend) insert(songs []*Song) {
 		llog.Fatal("Starting insert transaction failed: %q", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO songs(Uri, Title, Artist, Album, Year) VALUES(?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO songs(Uri, Title, Artist, Album, Year, Duration) VALUES(?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		llog.Fatal("Preparing inser statement failed: %q", err)
 	}
 	defer stmt.Close()
 
 	for _, song := range songs {
-		_, err = stmt.Exec(song.Uri, song.Title, song.Artist, song.Album, song.Year)
+		_, err = stmt.Exec(song.Uri, song.Title, song.Artist, song.Album, song.Year, song.Duration)
 		if err != nil {
 			llog.Fatal("Executing insert statement failed: %q", err)
 		}
@@ -114,6 +126,7 @@ func (b *LocalBackend) findSongs() {
 		s := NewSong(m.Title(), m.Artist(), "local", p)
 		s.Album = m.Album()
 		s.Year = m.Year()
+		s.Duration = probeDuration(p)
 		songs = append(songs, s)
 		return nil
 	})
@@ -125,8 +138,93 @@ func (b *LocalBackend) findSongs() {
 	b.insert(songs)
 }
 
-func (b *LocalBackend) Play(song *Song, player Player) {
+func (b *LocalBackend) Play(song *Song, player Player) error {
+	// The file may have been removed since the library was scanned
+	if _, err := os.Stat(song.Uri); err != nil {
+		b.opened.Discard(song)
+		return err
+	}
+
 	player.PlayUri("file://" + song.Uri)
+
+	// mpv opens the file on its own -> the prefetched file only warmed up the page cache
+	if f, ok := b.opened.Take(song); ok {
+		f.Close()
+	}
+	return nil
+}
+
+// Open the file and read it into the page cache to wake up slow disks and network mounts
+func (b *LocalBackend) Prefetch(song *Song) {
+	b.opened.Start(song, func(context.Context) (*os.File, error) {
+		f, err := os.Open(song.Uri)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reading stops with an error when the file is closed
+		go io.Copy(io.Discard, f) //nolint:errcheck
+		return f, nil
+	})
+}
+
+func (b *LocalBackend) Discard(song *Song) {
+	b.opened.Discard(song)
+}
+
+func (b *LocalBackend) Duration(song *Song) (float64, error) {
+	var duration float64
+	row := b.db.QueryRow("SELECT Duration FROM songs WHERE Uri = ?", song.Uri)
+	if err := row.Scan(&duration); err != nil {
+		return 0, err
+	}
+	return duration, nil
+}
+
+func (b *LocalBackend) RandomSong() *Song {
+	var uri, title, artist, album string
+	var year int
+	var duration float64
+
+	row := b.db.QueryRow("SELECT * FROM songs ORDER BY RANDOM() LIMIT 1")
+	if err := row.Scan(&uri, &title, &artist, &album, &year, &duration); err != nil {
+		if err != sql.ErrNoRows {
+			llog.Error("Selecting a random song failed: %q", err)
+		}
+		return nil
+	}
+
+	s := NewDetailedSong(title, artist, "local", uri, album, year)
+	s.Duration = duration
+	return s
+}
+
+var ffprobeMissing atomic.Bool
+
+// Return the duration of an audio file in seconds or 0 if it can not be determined
+func probeDuration(p string) float64 {
+	if ffprobeMissing.Load() {
+		return 0
+	}
+
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", p).Output()
+	if err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			llog.Warning("ffprobe is not available: song durations of local files are unknown")
+			ffprobeMissing.Store(true)
+		} else {
+			llog.Debug("Probing the duration of %s failed: %v", p, err)
+		}
+		return 0
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		llog.Debug("Parsing the duration %q of %s failed: %v", out, p, err)
+		return 0
+	}
+	return duration
 }
 
 func genericQuery(pattern string) string {
@@ -176,13 +274,15 @@ func (b *LocalBackend) Search(patterns map[string]string) (results []*Song) {
 		var artist string
 		var album string
 		var year int
+		var duration float64
 
-		err = rows.Scan(&uri, &title, &artist, &album, &year)
+		err = rows.Scan(&uri, &title, &artist, &album, &year, &duration)
 		if err != nil {
 			llog.Warning("Scanning query result failed: %q", err)
 		}
 
 		s := NewDetailedSong(title, artist, "local", uri, album, year)
+		s.Duration = duration
 		results = append(results, s)
 	}
 
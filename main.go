@@ -2,24 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/exp/slices"
 	"muhq.space/go/wrms/llog"
 
 	"github.com/google/uuid"
 )
 
-var wrms *Wrms
+// Default and maximum number of entries per page returned by the /history endpoint
+const (
+	HISTORY_PAGE_SIZE     = 20
+	MAX_HISTORY_PAGE_SIZE = 100
+)
+
 var pageTemplate *template.Template
 
-func landingPage(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) landingPage(w http.ResponseWriter, r *http.Request) {
 	var id uuid.UUID
 	if cookie, err := r.Cookie("UUID"); err != nil {
 		id, err = uuid.NewRandom()
@@ -27,7 +34,8 @@ func landingPage(w http.ResponseWriter, r *http.Request) {
 			llog.Fatal("Failed to generate random uuid: %v", err)
 		}
 
-		http.SetCookie(w, &http.Cookie{Name: "UUID", Value: id.String()})
+		// The connection id is shared between all rooms
+		http.SetCookie(w, &http.Cookie{Name: "UUID", Value: id.String(), Path: "/"})
 	} else {
 		id, err = uuid.Parse(cookie.Value)
 		if err != nil {
@@ -37,9 +45,10 @@ func landingPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tempData := struct {
+		Room    string
 		Config  Config
 		IsAdmin bool
-	}{wrms.Config, wrms.Config.IsAdmin(id)}
+	}{wrms.Name, wrms.Config, wrms.Config.IsAdmin(id)}
 
 	if err := pageTemplate.Execute(w, tempData); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -63,7 +72,7 @@ func getConnId(w http.ResponseWriter, r *http.Request) (uuid.UUID, error) {
 	return id, nil
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) searchHandler(w http.ResponseWriter, r *http.Request) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
@@ -112,30 +121,52 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Starting search for %v", searchQuery)
 }
 
-func genericVoteHandler(w http.ResponseWriter, r *http.Request, vote string) {
+func (wrms *Wrms) progressHandler(w http.ResponseWriter, r *http.Request) {
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	conn := wrms.GetConn(connId)
+	if conn == nil {
+		http.Error(w, "No websocket connection found", http.StatusInternalServerError)
+		return
+	}
+
+	// Querying the player may take a while -> do not block the request
+	go wrms.sendProgress(conn)
+	fmt.Fprintf(w, "Sending the progress")
+}
+
+func (wrms *Wrms) genericVoteHandler(w http.ResponseWriter, r *http.Request, vote string) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
 	}
 
-	songUri := r.URL.Query().Get("song")
-	llog.Info("%s song %s via url %s", vote, songUri, r.URL)
-	wrms.AdjustSongWeight(connId, songUri, vote)
+	songId := r.URL.Query().Get("id")
+	llog.Info("%s song %s via url %s", vote, songId, r.URL)
+	wrms.AdjustSongWeight(connId, songId, vote)
 }
 
-func upHandler(w http.ResponseWriter, r *http.Request) {
-	genericVoteHandler(w, r, "up")
+func (wrms *Wrms) upHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericVoteHandler(w, r, "up")
 }
 
-func downHandler(w http.ResponseWriter, r *http.Request) {
-	genericVoteHandler(w, r, "down")
+func (wrms *Wrms) downHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericVoteHandler(w, r, "down")
 }
 
-func unvoteHandler(w http.ResponseWriter, r *http.Request) {
-	genericVoteHandler(w, r, "unvote")
+func (wrms *Wrms) unvoteHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericVoteHandler(w, r, "unvote")
 }
 
-func addHandler(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) addHandler(w http.ResponseWriter, r *http.Request) {
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		llog.Warning("Failed to read request body: %s", string(data))
@@ -149,27 +180,41 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wrms.AddSong(song)
+	song.AddedBy = connId
+	song.Nickname = r.URL.Query().Get("nickname")
+	// Do not trust the duration posted by the client
+	song.Duration = wrms.Player.Duration(song)
+
+	if err := wrms.AddSong(song); err != nil {
+		wrms.notifyRejected(song, err)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrQuotaExceeded) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	fmt.Fprintf(w, "Added song %s", string(data))
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
 	}
 
-	if !wrms.Config.IsAdmin(connId) {
-		http.Error(w, "Only admins are allowed to delete songs", http.StatusUnauthorized)
+	songId := r.URL.Query().Get("id")
+	if !wrms.Config.IsAdmin(connId) && !wrms.IsSubmitter(connId, songId) {
+		http.Error(w, "Only admins and submitters are allowed to delete songs", http.StatusUnauthorized)
 		return
 	}
 
-	songUri := r.URL.Query().Get("song")
-	llog.Info("Delete song %s via url %s", songUri, r.URL)
-	wrms.DeleteSong(songUri)
+	llog.Info("Delete song %s via url %s", songId, r.URL)
+	wrms.DeleteSong(songId)
 }
 
-func genericControlHandler(w http.ResponseWriter, r *http.Request, cmd string) {
+func (wrms *Wrms) genericControlHandler(w http.ResponseWriter, r *http.Request, cmd string) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
@@ -185,18 +230,256 @@ func genericControlHandler(w http.ResponseWriter, r *http.Request, cmd string) {
 		wrms.PlayPause()
 	case "next":
 		wrms.Next()
+	case "volume":
+		var volume int
+		if volume, err = strconv.Atoi(r.URL.Query().Get("volume")); err != nil {
+			http.Error(w, "Invalid volume", http.StatusBadRequest)
+			return
+		}
+		err = wrms.SetVolume(volume)
+	case "seek":
+		var position float64
+		if position, err = strconv.ParseFloat(r.URL.Query().Get("position"), 64); err != nil {
+			http.Error(w, "Invalid position", http.StatusBadRequest)
+			return
+		}
+		err = wrms.Seek(position)
+	case "filter":
+		err = wrms.SetAudioFilter(r.URL.Query().Get("preset"))
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (wrms *Wrms) playPauseHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericControlHandler(w, r, "playpause")
+}
+
+func (wrms *Wrms) nextHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericControlHandler(w, r, "next")
+}
+
+func (wrms *Wrms) volumeHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericControlHandler(w, r, "volume")
+}
+
+func (wrms *Wrms) seekHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericControlHandler(w, r, "seek")
+}
+
+func (wrms *Wrms) filterHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericControlHandler(w, r, "filter")
+}
+
+func (wrms *Wrms) genericQueueHandler(w http.ResponseWriter, r *http.Request, cmd string) {
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	if !wrms.Config.IsAdmin(connId) {
+		http.Error(w, "Only admins are allowed to reorder the queue", http.StatusUnauthorized)
+		return
+	}
+
+	songId := r.URL.Query().Get("id")
+	llog.Info("%s song %s via url %s", cmd, songId, r.URL)
+
+	switch cmd {
+	case "pin":
+		err = wrms.PinSong(songId)
+	case "unpin":
+		err = wrms.UnpinSong(songId)
+	case "lock":
+		err = wrms.LockSong(songId, true)
+	case "unlock":
+		err = wrms.LockSong(songId, false)
+	case "move":
+		var position int
+		if position, err = strconv.Atoi(r.URL.Query().Get("position")); err != nil || position < 0 {
+			http.Error(w, "Invalid position", http.StatusBadRequest)
+			return
+		}
+		err = wrms.MoveSong(songId, position)
 	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (wrms *Wrms) pinHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericQueueHandler(w, r, "pin")
 }
 
-func playPauseHandler(w http.ResponseWriter, r *http.Request) {
-	genericControlHandler(w, r, "playpause")
+func (wrms *Wrms) unpinHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericQueueHandler(w, r, "unpin")
 }
 
-func nextHandler(w http.ResponseWriter, r *http.Request) {
-	genericControlHandler(w, r, "next")
+func (wrms *Wrms) lockHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericQueueHandler(w, r, "lock")
 }
 
-func adminHandler(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericQueueHandler(w, r, "unlock")
+}
+
+func (wrms *Wrms) moveHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericQueueHandler(w, r, "move")
+}
+
+func (wrms *Wrms) skipHandler(w http.ResponseWriter, r *http.Request) {
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := wrms.VoteSkip(connId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "Voted to skip the current song")
+}
+
+func (wrms *Wrms) historyHandler(w http.ResponseWriter, r *http.Request) {
+	page, size := 0, HISTORY_PAGE_SIZE
+
+	var err error
+	if p := r.URL.Query().Get("page"); p != "" {
+		if page, err = strconv.Atoi(p); err != nil || page < 0 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size <= 0 || size > MAX_HISTORY_PAGE_SIZE {
+			http.Error(w, "Invalid page size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	wrms.rwlock.RLock()
+	resp := struct {
+		Total   int             `json:"total"`
+		Entries []*HistoryEntry `json:"entries"`
+	}{len(wrms.History), wrms._historyPage(page, size)}
+	data, err := json.Marshal(resp)
+	wrms.rwlock.RUnlock()
+
+	if err != nil {
+		llog.Error("Encoding the history failed: %v", err)
+		http.Error(w, "Encoding the history failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", data)
+}
+
+func (wrms *Wrms) fallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		wrms.rwlock.RLock()
+		config := FallbackConfig{}
+		if wrms.fallback != nil {
+			config = wrms.fallback.Config
+		}
+		data, err := json.Marshal(config)
+		wrms.rwlock.RUnlock()
+
+		if err != nil {
+			http.Error(w, "Encoding the fallback playlist failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", data)
+		return
+	}
+
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	if !wrms.Config.IsAdmin(connId) {
+		http.Error(w, "Only admins are allowed to replace the fallback playlist", http.StatusUnauthorized)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		llog.Warning("Failed to read request body: %s", string(data))
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	var config FallbackConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		http.Error(w, "Could not parse fallback playlist", http.StatusBadRequest)
+		return
+	}
+
+	wrms.SetFallback(config)
+	fmt.Fprintf(w, "Replaced fallback playlist with %v", config.Playlists)
+}
+
+func (wrms *Wrms) bansHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.rwlock.RLock()
+	data, err := json.Marshal(wrms.Config.Bans)
+	wrms.rwlock.RUnlock()
+
+	if err != nil {
+		http.Error(w, "Encoding the ban list failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", data)
+}
+
+func (wrms *Wrms) genericBanHandler(w http.ResponseWriter, r *http.Request, ban bool) {
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	if !wrms.Config.IsAdmin(connId) {
+		http.Error(w, "Only admins are allowed to change the ban list", http.StatusUnauthorized)
+		return
+	}
+
+	kind, entry := "", ""
+	for _, k := range []string{BAN_SONG, BAN_ARTIST, BAN_PATTERN} {
+		if v := r.URL.Query().Get(k); v != "" {
+			kind, entry = k, v
+			break
+		}
+	}
+
+	if kind == "" {
+		http.Error(w, "No song, artist or pattern provided", http.StatusBadRequest)
+		return
+	}
+
+	llog.Info("Change ban of %s %s to %v via url %s", kind, entry, ban, r.URL)
+	if err := wrms.UpdateBans(kind, entry, ban); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (wrms *Wrms) banHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericBanHandler(w, r, true)
+}
+
+func (wrms *Wrms) unbanHandler(w http.ResponseWriter, r *http.Request) {
+	wrms.genericBanHandler(w, r, false)
+}
+
+func (wrms *Wrms) adminHandler(w http.ResponseWriter, r *http.Request) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
@@ -220,7 +503,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func eventsEndpoint(w http.ResponseWriter, r *http.Request) {
+func (wrms *Wrms) eventsEndpoint(w http.ResponseWriter, r *http.Request) {
 	connId, err := getConnId(w, r)
 	if err != nil {
 		return
@@ -247,18 +530,33 @@ func eventsEndpoint(w http.ResponseWriter, r *http.Request) {
 	conn.serve()
 }
 
-func setupRoutes() {
-	http.HandleFunc("/", landingPage)
-	http.HandleFunc("/search", searchHandler)
-	http.HandleFunc("/up", upHandler)
-	http.HandleFunc("/down", downHandler)
-	http.HandleFunc("/unvote", unvoteHandler)
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/delete", deleteHandler)
-	http.HandleFunc("/next", nextHandler)
-	http.HandleFunc("/playpause", playPauseHandler)
-	http.HandleFunc("/admin", adminHandler)
-	http.HandleFunc("/events", eventsEndpoint)
+func (wrms *Wrms) setupRoutes() {
+	wrms.mux.HandleFunc("/", wrms.landingPage)
+	wrms.mux.HandleFunc("/search", wrms.searchHandler)
+	wrms.mux.HandleFunc("/progress", wrms.progressHandler)
+	wrms.mux.HandleFunc("/up", wrms.upHandler)
+	wrms.mux.HandleFunc("/down", wrms.downHandler)
+	wrms.mux.HandleFunc("/unvote", wrms.unvoteHandler)
+	wrms.mux.HandleFunc("/add", wrms.addHandler)
+	wrms.mux.HandleFunc("/delete", wrms.deleteHandler)
+	wrms.mux.HandleFunc("/next", wrms.nextHandler)
+	wrms.mux.HandleFunc("/playpause", wrms.playPauseHandler)
+	wrms.mux.HandleFunc("/volume", wrms.volumeHandler)
+	wrms.mux.HandleFunc("/seek", wrms.seekHandler)
+	wrms.mux.HandleFunc("/filter", wrms.filterHandler)
+	wrms.mux.HandleFunc("/skip", wrms.skipHandler)
+	wrms.mux.HandleFunc("/pin", wrms.pinHandler)
+	wrms.mux.HandleFunc("/unpin", wrms.unpinHandler)
+	wrms.mux.HandleFunc("/lock", wrms.lockHandler)
+	wrms.mux.HandleFunc("/unlock", wrms.unlockHandler)
+	wrms.mux.HandleFunc("/move", wrms.moveHandler)
+	wrms.mux.HandleFunc("/bans", wrms.bansHandler)
+	wrms.mux.HandleFunc("/ban", wrms.banHandler)
+	wrms.mux.HandleFunc("/unban", wrms.unbanHandler)
+	wrms.mux.HandleFunc("/admin", wrms.adminHandler)
+	wrms.mux.HandleFunc("/history", wrms.historyHandler)
+	wrms.mux.HandleFunc("/fallback", wrms.fallbackHandler)
+	wrms.mux.HandleFunc("/events", wrms.eventsEndpoint)
 }
 
 func main() {
@@ -268,10 +566,14 @@ func main() {
 	flag.IntVar(&config.Port, "port", config.Port, "port to listen to")
 	flag.Float64Var(&config.TimeBonus, "time-bonus", config.TimeBonus,
 		"weight bonus granted over time")
+	flag.StringVar(&config.TimeBonusMode, "time-bonus-mode", config.TimeBonusMode,
+		"grant the time bonus on each added song (add) or per minute waited (continuous)")
 	backends := flag.String("backends", "", "music backend to use")
 	flag.StringVar(&config.LocalMusicDir,
 		"serve-music-dir", config.LocalMusicDir, "local music directory to serve")
 	flag.StringVar(&config.UploadDir, "upload-dir", config.UploadDir, "directory to upload songs to")
+	flag.StringVar(&config.StateFile, "state-file", config.StateFile,
+		"file to persist the queue across restarts")
 	playlists := flag.String("playlists", "", "playlists to load")
 	flag.Parse()
 
@@ -284,19 +586,13 @@ func main() {
 	}
 
 	llog.SetLogLevelFromString(config.LogLevel)
-	config.HasUpload = slices.Contains(config.Backends, "upload")
 
 	llog.Info("%v", config)
-	wrms = NewWrms(config)
-
-	setupRoutes()
+	rooms := NewRooms(config)
 
 	pageTemplate = template.Must(template.ParseFiles("web/client.html"))
 
-	// wrms.AddSong(NewDummySong("Lala", "SNFMT"))
-	// wrms.AddSong(NewDummySong("Hobelbank", "MC Wankwichtel"))
-
 	llog.Info("Serving http on %d", config.Port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port), rooms.mux)
 	llog.Error("Serving http failed with %s", err)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"muhq.space/go/wrms/llog"
+)
+
+const MPV_IPC_TIMEOUT = 5 * time.Second
+
+// A message received from mpv's JSON IPC.
+// Events have an event name while replies have the id of their request.
+type mpvMessage struct {
+	Event           string          `json:"event"`
+	RequestId       int64           `json:"request_id"`
+	Error           string          `json:"error"`
+	Data            json.RawMessage `json:"data"`
+	Reason          string          `json:"reason"`
+	PlaylistEntryId int64           `json:"playlist_entry_id"`
+	FileError       string          `json:"file_error"`
+	Name            string          `json:"name"`
+}
+
+// Connection to the JSON IPC socket of a running mpv
+type mpvConn struct {
+	conn    net.Conn
+	lock    sync.Mutex
+	nextId  int64
+	pending map[int64]chan mpvMessage
+	// Commands not answered within timeout fail
+	timeout time.Duration
+	// Events are delivered in order and the channel is closed if mpv goes away
+	Events chan mpvMessage
+}
+
+var ErrMpvGone = errors.New("mpv connection closed")
+
+// Connect to the IPC socket of a starting mpv
+func dialMpv(socket string, timeout time.Duration) (*mpvConn, error) {
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("connecting to mpv at %s failed: %w", socket, err)
+	}
+
+	c := &mpvConn{
+		conn:    conn,
+		pending: map[int64]chan mpvMessage{},
+		timeout: MPV_IPC_TIMEOUT,
+		Events:  make(chan mpvMessage, 16),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *mpvConn) readLoop() {
+	scanner := bufio.NewScanner(c.conn)
+	// Replies may contain large property values
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var msg mpvMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			llog.Warning("Failed to parse mpv message %s: %v", scanner.Text(), err)
+			continue
+		}
+
+		if msg.Event != "" {
+			llog.Debug("Received mpv event %s", scanner.Text())
+			c.Events <- msg
+			continue
+		}
+
+		c.lock.Lock()
+		reply, ok := c.pending[msg.RequestId]
+		delete(c.pending, msg.RequestId)
+		c.lock.Unlock()
+
+		if ok {
+			reply <- msg
+		}
+	}
+
+	llog.Debug("mpv IPC connection closed: %v", scanner.Err())
+
+	c.lock.Lock()
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	c.pending = nil
+	c.lock.Unlock()
+
+	close(c.Events)
+}
+
+// Run an mpv command and return the data of its reply
+func (c *mpvConn) Command(args ...any) (json.RawMessage, error) {
+	c.lock.Lock()
+	if c.pending == nil {
+		c.lock.Unlock()
+		return nil, ErrMpvGone
+	}
+
+	c.nextId++
+	id := c.nextId
+	reply := make(chan mpvMessage, 1)
+	c.pending[id] = reply
+
+	data, err := json.Marshal(map[string]any{"command": args, "request_id": id})
+	if err == nil {
+		llog.DDebug("Sending mpv command %s", data)
+		_, err = c.conn.Write(append(data, '\n'))
+	}
+
+	if err != nil {
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return nil, fmt.Errorf("sending mpv command %v failed: %w", args, err)
+	}
+	c.lock.Unlock()
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return nil, ErrMpvGone
+		}
+
+		if msg.Error != "success" {
+			return nil, fmt.Errorf("mpv command %v failed: %s", args, msg.Error)
+		}
+		return msg.Data, nil
+
+	case <-time.After(c.timeout):
+		c.lock.Lock()
+		if c.pending != nil {
+			delete(c.pending, id)
+		}
+		c.lock.Unlock()
+		return nil, fmt.Errorf("mpv command %v timed out", args)
+	}
+}
+
+func (c *mpvConn) SetProperty(name string, value any) error {
+	_, err := c.Command("set_property", name, value)
+	return err
+}
+
+func (c *mpvConn) Close() error {
+	return c.conn.Close()
+}
+
+// An entry of mpv's playlist
+type mpvEntry struct {
+	song *Song
+	// The fifo feeding the song's data to mpv
+	fifo string
+	// The song was played as current song and not only prepared to follow it
+	played  bool
+	started bool
+}
+
+// A long-running mpv playing one song after another.
+// Crossfades play the next song on a second deck.
+type mpvDeck struct {
+	name string
+	mpv  *exec.Cmd
+	ipc  *mpvConn
+	// Entries by their playlist entry id
+	entries map[int64]*mpvEntry
+	// mpv numbers the entries of its playlist in the order they were added
+	lastEntryId int64
+	// Closed to cancel the running volume fade
+	cancelFade chan struct{}
+}
+
+const FADE_STEPS_PER_SECOND = 10
+
+// Ramp the volume of the deck in the background
+func (deck *mpvDeck) fade(from, to int, d time.Duration) {
+	deck.stopFading()
+
+	steps := int(d.Seconds() * FADE_STEPS_PER_SECOND)
+	if steps < 1 {
+		steps = 1
+	}
+
+	cancel := make(chan struct{})
+	deck.cancelFade = cancel
+	ipc := deck.ipc
+
+	go func() {
+		ticker := time.NewTicker(d / time.Duration(steps))
+		defer ticker.Stop()
+
+		for i := 1; i <= steps; i++ {
+			select {
+			case <-cancel:
+				return
+			case <-ticker.C:
+			}
+
+			if err := ipc.SetProperty("volume", from+(to-from)*i/steps); err != nil {
+				llog.Debug("Fading deck %s stopped: %v", deck.name, err)
+				return
+			}
+		}
+	}()
+}
+
+func (deck *mpvDeck) stopFading() {
+	if deck.cancelFade != nil {
+		close(deck.cancelFade)
+		deck.cancelFade = nil
+	}
+}
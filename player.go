@@ -1,19 +1,36 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
+	"golang.org/x/exp/maps"
 	"muhq.space/go/wrms/llog"
 )
 
 type Player interface {
-	Play(*Song)
+	Play(*Song) error
 	Playing() bool
+	// Prepare a song to follow the current song without a gap
+	Prepare(*Song)
+	// Let the backend of a song prepare playing it in the background
+	Prefetch(*Song)
+	// Drop everything prefetched or prepared for a song which is no longer next
+	Discard(*Song)
+	Progress() (Progress, error)
+	SetVolume(volume int) error
+	Seek(position float64) error
+	SetAudioFilter(filter string) error
 	Search(map[string]string) chan []*Song
 	PlayUri(string)
 	PlayData(io.Reader)
@@ -21,6 +38,9 @@ type Player interface {
 	Continue()
 	Stop()
 	LoadPlaylist(playlist string) []*Song
+	RandomSong(source string) *Song
+	// Return the duration of the song known to its backend or 0 if it is unknown
+	Duration(*Song) float64
 }
 
 // command struct used to serialize player commands
@@ -28,13 +48,86 @@ type cmd struct {
 	cmd  string
 	data io.Reader
 	uri  string
+	song *Song
+	// The song is prepared to follow the current song
+	prepare bool
+	// Arguments of the audio controls
+	volume   int
+	position float64
+	filter   string
+	// The deck the command refers to
+	deck *mpvDeck
+	// Channel to answer queries on
+	result chan cmdResult
+}
+
+type cmdResult struct {
+	progress Progress
+	err      error
+}
+
+const (
+	// Interval to check if the current song is about to end
+	TRANSITION_CHECK_INTERVAL = 500 * time.Millisecond
+	// Remaining seconds of the current song when the next song is prepared
+	GAPLESS_PREPARE_TIME = 10
+	// Consecutive mpv failures after which restarting mpv is delayed
+	MPV_FAILURES_BEFORE_BACKOFF = 3
+	MPV_MIN_BACKOFF             = time.Second
+	MPV_MAX_BACKOFF             = time.Minute
+)
+
+var (
+	ErrMpvUnavailable = errors.New("mpv is not available")
+	ErrMpvExited      = errors.New("mpv terminated unexpectedly")
+)
+
+// A song waiting for mpv to become available again
+type pendingPlay struct {
+	uri   string
+	entry *mpvEntry
 }
 
 type MpvPlayer struct {
 	Backends map[string]Backend
 	wrms     *Wrms
-	mpv      atomic.Pointer[exec.Cmd]
 	cmdQueue chan cmd
+	// Closed to shut down serveCmds
+	done chan struct{}
+
+	// The decks and their mpv processes are only used by serveCmds
+	decks [2]*mpvDeck
+	// The deck playing the current song
+	active int
+	// Directory containing the IPC sockets and the fifos used by PlayData
+	runDir    string
+	fifoCount int
+	// Audio settings applied to every started mpv
+	volume      int
+	audioFilter string
+	paused      bool
+	// The songs for which the next song was prepared or the crossfade was started
+	preparedFor   *Song
+	crossfadeFrom *Song
+
+	// The song currently handed to the backend by Play or Prepare
+	requested *Song
+	preparing bool
+	// The song loaded into mpv
+	current atomic.Pointer[Song]
+	// The song appended to mpv's playlist to follow the current song
+	prepared atomic.Pointer[Song]
+
+	// Consecutive failures of mpv, which are reset when a song plays until its end
+	mpvFailures atomic.Int32
+	// mpv is not started again before retryAt
+	retryAt time.Time
+	// The song played as soon as mpv can be started again
+	pending *pendingPlay
+
+	// lock protects the entries of the decks, which are shared
+	// between serveCmds and the mpv event handlers
+	lock sync.Mutex
 }
 
 func NewMpvPlayer(wrms *Wrms, backends []string) *MpvPlayer {
@@ -45,15 +138,30 @@ func NewMpvPlayer(wrms *Wrms, backends []string) *MpvPlayer {
 	for _, backend := range backends {
 		switch backend {
 		case "spotify":
-			b, err = NewSpotify(wrms.Config.Spotify)
+			key := "spotify"
+			if wrms.Config.Spotify != nil {
+				key += ":" + wrms.Config.Spotify.Username
+			}
+			b, err = sharedBackends.get(key, func() (Backend, error) {
+				spotify, err := NewSpotify(wrms.Config.Spotify)
+				if err != nil {
+					return nil, err
+				}
+				return spotify, nil
+			})
 		case "youtube":
-			b = NewYoutubeBackend()
+			b, err = sharedBackends.get("youtube", func() (Backend, error) {
+				return NewYoutubeBackend(), nil
+			})
 		case "dummy":
 			b = &DummyBackend{}
 		case "local":
-			b = NewLocalBackend(wrms.Config.LocalMusicDir)
+			b, err = sharedBackends.get("local:"+wrms.Config.LocalMusicDir, func() (Backend, error) {
+				return NewLocalBackend(wrms.Config.LocalMusicDir), nil
+			})
+		// Each room stores its uploads in its own directory
 		case "upload":
-			b, err = NewUploadBackend(wrms.Config.UploadDir)
+			b, err = NewUploadBackend(wrms, wrms.Config.UploadDir)
 		default:
 			llog.Error("Not supported backend %s", backend)
 		}
@@ -68,172 +176,900 @@ func NewMpvPlayer(wrms *Wrms, backends []string) *MpvPlayer {
 	p := &MpvPlayer{
 		Backends: availableBackends,
 		wrms:     wrms,
-		cmdQueue: make(chan cmd)}
+		cmdQueue: make(chan cmd),
+		done:     make(chan struct{}),
+		volume:   DEFAULT_VOLUME,
+	}
+	for i, name := range []string{"a", "b"} {
+		p.decks[i] = &mpvDeck{name: name, entries: map[int64]*mpvEntry{}}
+	}
+
 	go p.serveCmds()
 	return p
 }
 
-const MPV_FLAGS = "--no-video"
+const MPV_FLAGS = "--no-video --idle=yes --no-terminal --prefetch-playlist=yes"
 
-func mpvArgv(uri string) []string {
-	cmd := []string{uri}
+func (player *MpvPlayer) mpvArgv(socket string) []string {
+	cmd := []string{"--input-ipc-server=" + socket, fmt.Sprintf("--volume=%d", player.volume)}
+	if player.audioFilter != "" {
+		cmd = append(cmd, "--af="+player.audioFilter)
+	}
 	cmd = append(cmd, strings.Split(MPV_FLAGS, " ")...)
-	if wrms.Config.MpvFlags != "" {
-		cmd = append(cmd, strings.Split(wrms.Config.MpvFlags, " ")...)
+	if player.wrms.Config.MpvFlags != "" {
+		cmd = append(cmd, strings.Split(player.wrms.Config.MpvFlags, " ")...)
 	}
 	return cmd
 }
 
-func (player *MpvPlayer) startMpv(uri string) *exec.Cmd {
-	if player.mpv.Load() != nil {
-		llog.Fatal("Player has already an mpv subprocess")
+func (player *MpvPlayer) _ensureRunDir() error {
+	if player.runDir != "" {
+		return nil
 	}
-	llog.Info("Start mpv to play %s", uri)
-
-	cmd := mpvArgv(uri)
-	llog.Debug("Running 'mpv %s'", strings.Join(cmd, " "))
 
-	// Since all player controll are serialized through cmdQueue no one
-	// else can modify player.mpv at this point.
-	mpv := exec.Command("mpv", cmd...)
-	player.mpv.Store(mpv)
-	return mpv
+	dir, err := os.MkdirTemp("", "wrms-mpv-")
+	if err != nil {
+		return fmt.Errorf("creating the mpv runtime directory failed: %w", err)
+	}
+	player.runDir = dir
+	return nil
 }
 
-func (player *MpvPlayer) runMpv() {
-	// Remember the song we are playing
-	// TODO: This is potentially racy
-	currentSong := wrms.CurrentSong.Load()
+// Start the mpv of the deck if it is not running and connect to its IPC socket
+func (player *MpvPlayer) _ensureMpv(deck *mpvDeck) error {
+	if deck.ipc != nil {
+		return nil
+	}
+
+	if wait := time.Until(player.retryAt); wait > 0 {
+		return fmt.Errorf("mpv failed repeatedly: retrying in %v", wait.Round(time.Second))
+	}
+
+	if err := player._ensureRunDir(); err != nil {
+		return err
+	}
 
-	mpv := player.mpv.Load()
-	output, err := mpv.CombinedOutput()
+	socket := path.Join(player.runDir, "mpv-"+deck.name+".sock")
+	os.Remove(socket)
+
+	argv := player.mpvArgv(socket)
+	llog.Info("Start mpv for deck %s", deck.name)
+	llog.Debug("Running 'mpv %s'", strings.Join(argv, " "))
+
+	mpv := exec.Command("mpv", argv...)
+	if err := mpv.Start(); err != nil {
+		err = fmt.Errorf("starting mpv failed: %w", err)
+		player._mpvFailed(err)
+		return err
+	}
+
+	ipc, err := dialMpv(socket, MPV_IPC_TIMEOUT)
 	if err != nil {
-		// mpv returns exit code 4 if it teminates due to a signal
-		if err.(*exec.ExitError).ExitCode() != 4 {
-			llog.Debug("Mpv output: %s", output)
-			llog.Fatal("Mpv failed with: %s", err)
+		mpv.Process.Kill()
+		mpv.Wait()
+		player._mpvFailed(err)
+		return err
+	}
+
+	deck.mpv = mpv
+	deck.ipc = ipc
+	deck.lastEntryId = 0
+	go player.handleEvents(deck, mpv, ipc)
+	return nil
+}
+
+// Handle the events of a deck's mpv until its IPC connection is closed
+func (player *MpvPlayer) handleEvents(deck *mpvDeck, mpv *exec.Cmd, ipc *mpvConn) {
+	for ev := range ipc.Events {
+		switch ev.Event {
+		case "start-file":
+			player.lock.Lock()
+			if entry := deck.entries[ev.PlaylistEntryId]; entry != nil {
+				entry.started = true
+			}
+			player.lock.Unlock()
+
+		case "end-file":
+			player.lock.Lock()
+			entry := deck.entries[ev.PlaylistEntryId]
+			delete(deck.entries, ev.PlaylistEntryId)
+			played := entry != nil && entry.isPlayed()
+			player.lock.Unlock()
+
+			if entry == nil {
+				// Prepared songs replaced before their start was reported
+				llog.Debug("mpv finished an unknown file %d: %s", ev.PlaylistEntryId, ev.Reason)
+				continue
+			}
+
+			player.entryEnded(entry, played, ev)
 		}
 	}
 
-	player.mpv.Store(nil)
-	player.Backends[currentSong.Source].OnSongFinished(currentSong)
+	err := mpv.Wait()
+	select {
+	case <-player.done:
+		return
+	default:
+	}
+
+	llog.Error("mpv of deck %s terminated unexpectedly: %v", deck.name, err)
+	select {
+	case player.cmdQueue <- cmd{cmd: "mpvExited", deck: deck}:
+	case <-player.done:
+	}
+}
+
+// Clean up after mpv stopped playing an entry and continue with the next song
+// if mpv reached the end of the current song or failed to play it
+func (player *MpvPlayer) entryEnded(entry *mpvEntry, played bool, ev mpvMessage) {
+	player.releaseFifo(entry)
+
+	// The song was only prepared and is still in the queue
+	if !played {
+		return
+	}
+
+	song := entry.song
+	player.current.CompareAndSwap(song, nil)
+	player.Backends[song.Source].OnSongFinished(song)
 
-	// mpv terminated because it finished playing the song
-	if err == nil {
-		llog.Info("mpv finished. Resetting mpv, and calling next")
-		wrms._lockedNext()
+	// Do not block the event handling because playing the next song sends
+	// commands to mpv
+	switch ev.Reason {
+	case "eof":
+		llog.Info("mpv finished playing %v", song)
+		player.mpvFailures.Store(0)
+		go player.wrms.SongFinished(song)
+	case "error":
+		go player.wrms.SongFailed(song, fmt.Errorf("mpv failed to play it: %s", ev.FileError))
 	}
 }
 
+// played is set by serveCmds: the lock must be held when calling isPlayed
+// from the mpv event handlers.
+func (entry *mpvEntry) isPlayed() bool {
+	return entry.song != nil && entry.played
+}
+
 func (p *MpvPlayer) serveCmds() {
-	for cmd := range p.cmdQueue {
-		switch cmd.cmd {
-		case "playData":
-			p._playData(cmd.data)
-		case "playUri":
-			p._playUri(cmd.uri)
-		case "pause":
-			p._pause()
-		case "continue":
-			p._continue()
-		case "stop":
-			p._stop()
+	ticker := time.NewTicker(TRANSITION_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case cmd := <-p.cmdQueue:
+			p._serveCmd(cmd)
+
+		case <-p.done:
+			p._shutdown()
+			return
+
+		case <-ticker.C:
+			p._retryPending()
+			p._checkTransition()
+		}
+	}
+}
+
+func (p *MpvPlayer) _serveCmd(cmd cmd) {
+	switch cmd.cmd {
+	case "playData":
+		p._playData(cmd.data, cmd.song, cmd.prepare)
+	case "playUri":
+		p._playUri(cmd.uri, cmd.song, cmd.prepare)
+	case "playPrepared":
+		p._playPrepared(cmd.song)
+	case "unprepare":
+		p._unprepare(cmd.song)
+	case "pause":
+		p._pause()
+	case "continue":
+		p._continue()
+	case "stop":
+		p._stop()
+	case "progress":
+		progress, err := p._progress()
+		cmd.result <- cmdResult{progress: progress, err: err}
+	case "volume":
+		cmd.result <- cmdResult{err: p._setVolume(cmd.volume)}
+	case "seek":
+		cmd.result <- cmdResult{err: p._seek(cmd.position)}
+	case "filter":
+		cmd.result <- cmdResult{err: p._setAudioFilter(cmd.filter)}
+	case "mpvExited":
+		p._mpvExited(cmd.deck)
+	}
+}
+
+// Count a failure of mpv and delay starting it again if it keeps failing
+func (p *MpvPlayer) _mpvFailed(err error) {
+	failures := int(p.mpvFailures.Add(1))
+	if failures < MPV_FAILURES_BEFORE_BACKOFF {
+		return
+	}
+
+	backoff := MPV_MAX_BACKOFF
+	if shift := failures - MPV_FAILURES_BEFORE_BACKOFF; shift < 6 {
+		backoff = MPV_MIN_BACKOFF << shift
+		if backoff > MPV_MAX_BACKOFF {
+			backoff = MPV_MAX_BACKOFF
 		}
 	}
+	p.retryAt = time.Now().Add(backoff)
+
+	err = fmt.Errorf("mpv failed %d times in a row (%v): retrying in %v", failures, err, backoff)
+	llog.Error("%v", err)
+	go p.wrms.PlayerFailing(err)
 }
 
-// Play arbitrary media using mpv
-func (p *MpvPlayer) PlayUri(uri string)      { p.cmdQueue <- cmd{cmd: "playUri", uri: uri} }
-func (p *MpvPlayer) PlayData(data io.Reader) { p.cmdQueue <- cmd{cmd: "playData", data: data} }
+// Play the song waiting for mpv once mpv may be started again
+func (p *MpvPlayer) _retryPending() {
+	pending := p.pending
+	if pending == nil || p.paused || time.Now().Before(p.retryAt) {
+		return
+	}
+
+	p.pending = nil
+	llog.Info("Retry playing %v", pending.entry.song)
+	if err := p._play(pending.uri, pending.entry); err != nil {
+		p._playFailed(pending.uri, pending.entry, err)
+	}
+}
+
+// Wait for mpv if it is not available or skip a song mpv failed to play
+func (p *MpvPlayer) _playFailed(uri string, entry *mpvEntry, err error) {
+	song := entry.song
+	if song != nil && errors.Is(err, ErrMpvUnavailable) {
+		llog.Warning("Playing %v is delayed: %v", song, err)
+		p._dropPendingPlay()
+		p.pending = &pendingPlay{uri: uri, entry: entry}
+		// The song counts as playing to be stopped when it is skipped
+		p.current.Store(song)
+		return
+	}
+
+	llog.Error("Playing %s failed: %v", uri, err)
+	p.releaseFifo(entry)
+	if song == nil {
+		return
+	}
+
+	p.current.CompareAndSwap(song, nil)
+	p.Backends[song.Source].OnSongFinished(song)
+	go p.wrms.SongFailed(song, err)
+}
+
+func (p *MpvPlayer) _dropPendingPlay() {
+	if p.pending != nil {
+		p.releaseFifo(p.pending.entry)
+		p.pending = nil
+	}
+}
+
+func (p *MpvPlayer) _shutdown() {
+	p._dropPendingPlay()
+
+	for _, deck := range p.decks {
+		if deck.ipc != nil {
+			deck.stopFading()
+			deck.ipc.Command("quit")
+			deck.ipc.Close()
+		}
+	}
+
+	if p.runDir != "" {
+		os.RemoveAll(p.runDir)
+	}
+}
+
+// Prepare the next song or start the crossfade when the current song is about to end
+func (p *MpvPlayer) _checkTransition() {
+	song := p.current.Load()
+	deck := p.decks[p.active]
+	if song == nil || deck.ipc == nil || p.paused || p.crossfadeFrom == song {
+		return
+	}
+
+	crossfade := p.wrms.Config.Crossfade
+	if crossfade <= 0 && p.preparedFor == song {
+		return
+	}
+
+	// Streams without a known duration have no remaining time
+	data, err := deck.ipc.Command("get_property", "time-remaining")
+	if err != nil {
+		return
+	}
+
+	var remaining float64
+	if err := json.Unmarshal(data, &remaining); err != nil {
+		return
+	}
+
+	if crossfade > 0 {
+		if remaining > crossfade {
+			return
+		}
+
+		// Let the queue advance now -> the next song is played on the other deck
+		llog.Info("Start crossfading from %v", song)
+		p.crossfadeFrom = song
+		go p.wrms.SongFinished(song)
+		return
+	}
+
+	if remaining <= GAPLESS_PREPARE_TIME {
+		p.preparedFor = song
+		go p.wrms.PrepareNext(song)
+	}
+}
+
+// Play arbitrary media using mpv.
+// Songs are only tracked if the media is played by a backend during Play or Prepare.
+func (p *MpvPlayer) PlayUri(uri string) {
+	p.cmdQueue <- cmd{cmd: "playUri", uri: uri, song: p.requested, prepare: p.preparing}
+}
+
+func (p *MpvPlayer) PlayData(data io.Reader) {
+	p.cmdQueue <- cmd{cmd: "playData", data: data, song: p.requested, prepare: p.preparing}
+}
 
 // Controls
 func (p *MpvPlayer) Pause()    { p.cmdQueue <- cmd{cmd: "pause"} }
 func (p *MpvPlayer) Continue() { p.cmdQueue <- cmd{cmd: "continue"} }
-func (p *MpvPlayer) Stop()     { p.cmdQueue <- cmd{cmd: "stop"} }
-func (p *MpvPlayer) Close()    { close(p.cmdQueue) }
+
+func (p *MpvPlayer) Stop() {
+	// The prepared song must not be played by a following Play call
+	p.prepared.Store(nil)
+	p.cmdQueue <- cmd{cmd: "stop"}
+}
+
+func (p *MpvPlayer) Close() {
+	close(p.done)
+}
+
+var ErrUnknownBackend = errors.New("unknown backend")
+
+func (p *MpvPlayer) backend(song *Song) (Backend, error) {
+	backend, ok := p.Backends[song.Source]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, song.Source)
+	}
+	return backend, nil
+}
 
 // Double dispatch play entry point
-func (p *MpvPlayer) Play(song *Song) {
+func (p *MpvPlayer) Play(song *Song) error {
+	// The song is already loaded to follow the previous song
+	if p.prepared.CompareAndSwap(song, nil) {
+		llog.Info("Continue with the prepared song %v", song)
+		p.cmdQueue <- cmd{cmd: "playPrepared", song: song}
+		return nil
+	}
+
 	llog.Info("Start playing %v", song)
-	p.Backends[song.Source].Play(song, p)
+	// The song replaces a prepared song, which must not be played later without its backend
+	p.prepared.Store(nil)
+
+	backend, err := p.backend(song)
+	if err != nil {
+		return err
+	}
+
+	// Play is always called with the rwlock held -> requested is not shared
+	p.requested = song
+	defer func() { p.requested = nil }()
+	return backend.Play(song, p)
+}
+
+// Let the backend load the song after the current song
+func (p *MpvPlayer) Prepare(song *Song) {
+	llog.Info("Prepare %v to follow the current song", song)
+	backend, err := p.backend(song)
+	if err != nil {
+		llog.Warning("Preparing %v failed: %v", song, err)
+		return
+	}
+
+	// Prepare is always called with the rwlock held -> requested is not shared
+	p.requested = song
+	p.preparing = true
+	if err := backend.Play(song, p); err != nil {
+		// The song is played regularly and fails again if it is still at the top
+		llog.Warning("Preparing %v failed: %v", song, err)
+	}
+	p.requested = nil
+	p.preparing = false
+}
+
+func (p *MpvPlayer) Prefetch(song *Song) {
+	if prefetcher, ok := p.Backends[song.Source].(Prefetcher); ok {
+		llog.Debug("Prefetch %v", song)
+		prefetcher.Prefetch(song)
+	}
 }
 
+func (p *MpvPlayer) Discard(song *Song) {
+	// mpv must not start a prepared song which is no longer next on its own
+	if p.prepared.CompareAndSwap(song, nil) {
+		p.cmdQueue <- cmd{cmd: "unprepare", song: song}
+	}
+
+	if prefetcher, ok := p.Backends[song.Source].(Prefetcher); ok {
+		prefetcher.Discard(song)
+	}
+}
+
+// A prepared song counts as playing because mpv starts it on its own
 func (p *MpvPlayer) Playing() bool {
-	return p.mpv.Load() != nil
+	return p.current.Load() != nil || p.prepared.Load() != nil
+}
+
+// Send a command to serveCmds and wait for its result
+func (p *MpvPlayer) query(c cmd) cmdResult {
+	c.result = make(chan cmdResult, 1)
+	p.cmdQueue <- c
+	return <-c.result
+}
+
+func (p *MpvPlayer) Progress() (Progress, error) {
+	r := p.query(cmd{cmd: "progress"})
+	return r.progress, r.err
+}
+
+func (p *MpvPlayer) SetVolume(volume int) error {
+	return p.query(cmd{cmd: "volume", volume: volume}).err
+}
+
+func (p *MpvPlayer) Seek(position float64) error {
+	return p.query(cmd{cmd: "seek", position: position}).err
+}
+
+// Apply an mpv audio filter chain. The empty filter removes all filters.
+func (p *MpvPlayer) SetAudioFilter(filter string) error {
+	return p.query(cmd{cmd: "filter", filter: filter}).err
+}
+
+// Drop the entries mpv did not start yet, which mpv discards on replace and stop
+// without any events.
+// The lock must be held when calling _dropPending.
+func (player *MpvPlayer) _dropPending(deck *mpvDeck) []*mpvEntry {
+	var dropped []*mpvEntry
+	for id, entry := range deck.entries {
+		if !entry.started {
+			dropped = append(dropped, entry)
+			delete(deck.entries, id)
+		}
+	}
+	return dropped
+}
+
+// Load media into a deck's mpv. The media replaces the playing media
+// or is appended to follow it if it is prepared.
+func (player *MpvPlayer) _load(deck *mpvDeck, uri string, entry *mpvEntry, prepare bool) error {
+	if err := player._ensureMpv(deck); err != nil {
+		return fmt.Errorf("%w: %v", ErrMpvUnavailable, err)
+	}
+
+	mode := "replace"
+	if prepare {
+		mode = "append"
+	}
+
+	var dropped []*mpvEntry
+	player.lock.Lock()
+	if !prepare {
+		dropped = player._dropPending(deck)
+	}
+	// Register the entry before mpv can report its start
+	deck.lastEntryId++
+	id := deck.lastEntryId
+	deck.entries[id] = entry
+	player.lock.Unlock()
+
+	for _, e := range dropped {
+		player.releaseFifo(e)
+	}
+
+	data, err := deck.ipc.Command("loadfile", uri, mode)
+	if err != nil {
+		player.lock.Lock()
+		delete(deck.entries, id)
+		deck.lastEntryId--
+		player.lock.Unlock()
+		return err
+	}
+
+	// Newer mpv versions report the playlist entry id of the loaded file.
+	// It only differs from the expected id if mpv expanded a playlist.
+	var reply struct {
+		PlaylistEntryId int64 `json:"playlist_entry_id"`
+	}
+	if json.Unmarshal(data, &reply) == nil && reply.PlaylistEntryId != 0 && reply.PlaylistEntryId != id {
+		llog.Warning("mpv assigned the entry id %d instead of %d", reply.PlaylistEntryId, id)
+		player.lock.Lock()
+		delete(deck.entries, id)
+		deck.entries[reply.PlaylistEntryId] = entry
+		deck.lastEntryId = reply.PlaylistEntryId
+		player.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Play a song on the active deck or on the other deck if the current song fades out
+func (player *MpvPlayer) _play(uri string, entry *mpvEntry) error {
+	crossfade := player.crossfadeFrom != nil && player.crossfadeFrom == player.current.Load()
+
+	next := player.active
+	if crossfade {
+		next = 1 - player.active
+	}
+	deck := player.decks[next]
+
+	if err := player._load(deck, uri, entry, false); err != nil {
+		return err
+	}
+
+	// Fading may have left the deck silent
+	volume := player.volume
+	if crossfade {
+		volume = 0
+	}
+	deck.stopFading()
+	if err := deck.ipc.SetProperty("volume", volume); err != nil {
+		llog.Warning("Setting the volume of deck %s failed: %v", deck.name, err)
+	}
+
+	player.lock.Lock()
+	entry.played = true
+	player.lock.Unlock()
+
+	if crossfade {
+		d := time.Duration(player.wrms.Config.Crossfade * float64(time.Second))
+		player.decks[player.active].fade(player.volume, 0, d)
+		deck.fade(0, player.volume, d)
+	}
+
+	player.active = next
+	player.current.Store(entry.song)
+	player.paused = false
+	// The song is loaded -> losing mpv now is handled as its termination
+	if err := deck.ipc.SetProperty("pause", false); err != nil {
+		llog.Warning("Continuing deck %s failed: %v", deck.name, err)
+	}
+	return nil
+}
+
+func (player *MpvPlayer) _playUri(uri string, song *Song, prepare bool) {
+	entry := &mpvEntry{song: song}
+	if prepare {
+		llog.Info("Let mpv play %s next", uri)
+		if err := player._prepare(uri, entry); err != nil {
+			llog.Warning("Preparing %s failed: %v", uri, err)
+		}
+		return
+	}
+
+	llog.Info("Let mpv play %s", uri)
+	if err := player._play(uri, entry); err != nil {
+		player._playFailed(uri, entry, err)
+	}
 }
 
-func (player *MpvPlayer) _playUri(uri string) {
-	player.startMpv(uri)
-	go player.runMpv()
+// Append a song to the playlist of the active deck to start it without a gap
+func (player *MpvPlayer) _prepare(uri string, entry *mpvEntry) error {
+	if player.current.Load() == nil {
+		return fmt.Errorf("the song to follow already ended")
+	}
+
+	if err := player._load(player.decks[player.active], uri, entry, true); err != nil {
+		return err
+	}
+
+	player.prepared.Store(entry.song)
+	return nil
 }
 
-func (player *MpvPlayer) _playData(data io.Reader) {
-	mpv := player.startMpv("-")
+// Take over the prepared song as current song
+func (player *MpvPlayer) _playPrepared(song *Song) {
+	deck := player.decks[player.active]
+
+	player.lock.Lock()
+	var found bool
+	for _, entry := range deck.entries {
+		if entry.song == song {
+			entry.played = true
+			found = true
+		}
+	}
+	player.lock.Unlock()
+
+	if !found {
+		go player.wrms.SongFailed(song, errors.New("the prepared song is not loaded anymore"))
+		return
+	}
+
+	player.current.Store(song)
+	player.paused = false
+	if err := deck.ipc.SetProperty("pause", false); err != nil {
+		llog.Warning("Continuing mpv failed: %v", err)
+	}
+}
+
+// Remove a prepared song from the playlist of the active deck
+func (player *MpvPlayer) _unprepare(song *Song) {
+	deck := player.decks[player.active]
+	// Prepare the new next song when the current song is about to end
+	player.preparedFor = nil
+	if deck.ipc == nil {
+		return
+	}
+
+	player.lock.Lock()
+	var id int64
+	var entry *mpvEntry
+	for i, e := range deck.entries {
+		if e.song == song && !e.played && !e.started {
+			id, entry = i, e
+		}
+	}
+	player.lock.Unlock()
+
+	// A started song is replaced when the next song is played
+	if entry == nil {
+		return
+	}
 
-	stdin, err := mpv.StdinPipe()
+	// playlist-remove expects the position of the entry in the playlist
+	data, err := deck.ipc.Command("get_property", "playlist")
 	if err != nil {
-		llog.Fatal("Connecting to mpv Pipe failed: %v", err)
+		llog.Warning("Getting the playlist of deck %s failed: %v", deck.name, err)
+		return
+	}
+
+	var playlist []struct {
+		Id int64 `json:"id"`
+	}
+	if err := json.Unmarshal(data, &playlist); err != nil {
+		llog.Warning("Invalid mpv playlist %s: %v", data, err)
+		return
+	}
+
+	index := -1
+	for i, e := range playlist {
+		if e.Id == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		llog.Debug("The prepared %v is not in the playlist anymore", song)
+		return
+	}
+
+	llog.Info("Remove the prepared %v which is no longer next", song)
+	if _, err := deck.ipc.Command("playlist-remove", index); err != nil {
+		llog.Warning("Removing the prepared %v failed: %v", song, err)
+		return
+	}
+
+	// mpv removes entries which did not start without any events
+	player.lock.Lock()
+	delete(deck.entries, id)
+	player.lock.Unlock()
+	player.releaseFifo(entry)
+}
+
+// Feed the data to mpv through a fifo because the long-running mpv has no usable stdin
+func (player *MpvPlayer) _playData(data io.Reader, song *Song, prepare bool) {
+	if err := player._ensureRunDir(); err != nil {
+		player._playFailed("song data", &mpvEntry{song: song}, err)
+		return
+	}
+
+	player.fifoCount++
+	fifo := path.Join(player.runDir, fmt.Sprintf("data-%d.fifo", player.fifoCount))
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		player._playFailed(fifo, &mpvEntry{song: song}, err)
+		return
 	}
 
 	go func() {
-		defer stdin.Close()
+		defer os.Remove(fifo)
 
-		if _, err := io.Copy(stdin, data); err != nil {
+		// Opening blocks until mpv or releaseFifo opens the reading end
+		w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			llog.Warning("Opening the fifo %s failed: %v", fifo, err)
+			return
+		}
+		defer w.Close()
+
+		if _, err := io.Copy(w, data); err != nil {
 			llog.Warning("Failed to write song data to mpv: %v", err)
 		}
 	}()
 
-	go player.runMpv()
+	entry := &mpvEntry{song: song, fifo: fifo}
+	if prepare {
+		if err := player._prepare(fifo, entry); err != nil {
+			llog.Warning("Preparing song data failed: %v", err)
+			player.releaseFifo(entry)
+		}
+		return
+	}
+
+	if err := player._play(fifo, entry); err != nil {
+		player._playFailed(fifo, entry, err)
+	}
 }
 
-func (player *MpvPlayer) _pause() {
-	mpv := player.mpv.Load()
-	if mpv == nil {
-		llog.Warning("No mpv process to pause")
+// Unblock the writer of an entry's fifo if mpv never opened it
+func (player *MpvPlayer) releaseFifo(entry *mpvEntry) {
+	if entry.fifo == "" {
 		return
 	}
 
-	llog.Debug("Send SIGSTOP to mpv subprocess")
-	err := mpv.Process.Signal(syscall.SIGSTOP)
-	if err != nil {
-		llog.Fatal("Failed to send SIGSTOP to mpv")
+	if r, err := os.OpenFile(entry.fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+		r.Close()
 	}
 }
 
-func (player *MpvPlayer) _continue() {
-	mpv := player.mpv.Load()
-	if mpv == nil {
-		llog.Warning("Continue Play but there is no running mpv process to continue")
-		return
+func (player *MpvPlayer) _progress() (Progress, error) {
+	var p Progress
+	deck := player.decks[player.active]
+	if deck.ipc == nil || player.current.Load() == nil {
+		return p, ErrNotPlaying
 	}
 
-	llog.Debug("Send SIGCONT to mpv subprocess")
-	err := mpv.Process.Signal(syscall.SIGCONT)
+	data, err := deck.ipc.Command("get_property", "time-pos")
 	if err != nil {
-		llog.Fatal("Failed to send SIGCONT to mpv")
+		return p, err
+	}
+
+	if err := json.Unmarshal(data, &p.Position); err != nil {
+		return p, fmt.Errorf("invalid mpv position %s: %w", data, err)
 	}
+
+	// Streamed songs may have no known duration
+	if data, err := deck.ipc.Command("get_property", "duration"); err == nil {
+		json.Unmarshal(data, &p.Duration)
+	}
+
+	return p, nil
+}
+
+// The volume is remembered if mpv is not running
+func (player *MpvPlayer) _setVolume(volume int) error {
+	player.volume = volume
+	deck := player.decks[player.active]
+	if deck.ipc == nil {
+		return nil
+	}
+
+	deck.stopFading()
+	return deck.ipc.SetProperty("volume", volume)
+}
+
+func (player *MpvPlayer) _seek(position float64) error {
+	deck := player.decks[player.active]
+	if deck.ipc == nil || player.current.Load() == nil {
+		return ErrNotPlaying
+	}
+
+	_, err := deck.ipc.Command("seek", position, "absolute")
+	return err
+}
+
+// The filter is remembered if mpv is not running
+func (player *MpvPlayer) _setAudioFilter(filter string) error {
+	for _, deck := range player.decks {
+		if deck.ipc == nil {
+			continue
+		}
+
+		if err := deck.ipc.SetProperty("af", filter); err != nil {
+			return err
+		}
+	}
+
+	player.audioFilter = filter
+	return nil
+}
+
+// Pausing and continuing applies to both decks to not let a crossfade continue
+func (player *MpvPlayer) _setPause(pause bool) {
+	running := false
+	for _, deck := range player.decks {
+		if deck.ipc == nil {
+			continue
+		}
+
+		running = true
+		if err := deck.ipc.SetProperty("pause", pause); err != nil {
+			llog.Error("Setting pause=%v of deck %s failed: %v", pause, deck.name, err)
+		}
+	}
+
+	if !running {
+		llog.Warning("No mpv process to pause or continue")
+	}
+	// A song waiting for mpv is not started while paused
+	player.paused = pause
+}
+
+func (player *MpvPlayer) _pause() {
+	player._setPause(true)
+}
+
+func (player *MpvPlayer) _continue() {
+	player._setPause(false)
 }
 
 func (player *MpvPlayer) _stop() {
-	mpv := player.mpv.Load()
-	if mpv == nil {
-		// Wrms.Next() may race with Player.runMpv() therefore this must not be a hard error
-		llog.Warning("There is no mpv process to terminate")
-		return
+	// Let a song fading out without a following song play until its end
+	fadingOut := player.crossfadeFrom != nil && player.crossfadeFrom == player.current.Load()
+
+	running := false
+	for _, deck := range player.decks {
+		if deck.ipc == nil {
+			continue
+		}
+
+		// The end-file events clean up after the stopped songs
+		running = true
+		if !fadingOut {
+			deck.stopFading()
+			if _, err := deck.ipc.Command("stop"); err != nil {
+				llog.Warning("Stopping mpv failed: %v", err)
+			}
+		}
+
+		// Prepared songs are discarded without events
+		player.lock.Lock()
+		dropped := player._dropPending(deck)
+		player.lock.Unlock()
+		for _, entry := range dropped {
+			player.releaseFifo(entry)
+		}
 	}
 
-	// mpv is actually running.
-	if mpv.Process != nil {
-		llog.Debug("Send SIGTERM to mpv subprocess")
-		err := mpv.Process.Signal(syscall.SIGTERM)
-		if err != nil {
-			llog.Warning("Signalling mpv with SIGTERM failed: %v", err)
+	if !running && player.pending == nil {
+		// Wrms.Next() may race with the end of the song therefore this must not be a hard error
+		llog.Warning("There is no mpv process to stop")
+	}
+
+	player._dropPendingPlay()
+	player.current.Store(nil)
+	player.prepared.Store(nil)
+}
+
+// Forget the dead mpv of a deck. The next song played on the deck starts a new one.
+func (player *MpvPlayer) _mpvExited(deck *mpvDeck) {
+	deck.stopFading()
+	deck.ipc.Close()
+	deck.ipc = nil
+	deck.mpv = nil
+
+	player.lock.Lock()
+	lost := maps.Values(deck.entries)
+	deck.entries = map[int64]*mpvEntry{}
+	deck.lastEntryId = 0
+	player.lock.Unlock()
+
+	for _, entry := range lost {
+		player.releaseFifo(entry)
+		if entry.isPlayed() {
+			player.current.CompareAndSwap(entry.song, nil)
+			player.Backends[entry.song.Source].OnSongFinished(entry.song)
+			go player.wrms.SongFailed(entry.song, ErrMpvExited)
+		} else if entry.song != nil {
+			player.prepared.CompareAndSwap(entry.song, nil)
 		}
-	} else {
-		llog.Fatal("mpv process is not running yet")
 	}
 
-	player.mpv.Store(nil)
+	player._mpvFailed(ErrMpvExited)
 }
 
 func (player *MpvPlayer) Search(pattern map[string]string) chan []*Song {
@@ -255,7 +1091,32 @@ func (player *MpvPlayer) Search(pattern map[string]string) chan []*Song {
 		close(ch)
 	}()
 
-	return ch
+	return player.wrms.filterBanned(collapseSearchResults(ch))
+}
+
+func (player *MpvPlayer) RandomSong(source string) *Song {
+	backend, ok := player.Backends[source].(RandomSongProvider)
+	if !ok {
+		llog.Debug("Backend %s can not provide random songs", source)
+		return nil
+	}
+
+	return backend.RandomSong()
+}
+
+func (player *MpvPlayer) Duration(song *Song) float64 {
+	backend, ok := player.Backends[song.Source].(DurationProvider)
+	if !ok {
+		llog.Debug("Backend %s can not provide song durations", song.Source)
+		return 0
+	}
+
+	duration, err := backend.Duration(song)
+	if err != nil {
+		llog.Warning("Looking up the duration of %v failed: %v", song, err)
+		return 0
+	}
+	return duration
 }
 
 func (player *MpvPlayer) LoadPlaylist(playlist string) (songs []*Song) {
@@ -2,91 +2,392 @@ package main
 
 import (
 	"container/heap"
+	"sort"
+	"time"
+
 	"muhq.space/go/wrms/llog"
+
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+)
+
+// Orderings of the queue
+const (
+	QUEUE_MODE_VOTE = "vote"
+	QUEUE_MODE_FAIR = "fair"
 )
 
-type Playlist []*Song
+type Playlist struct {
+	songs   []*Song
+	ranking RankingStrategy
+	// Rotate between the submitters instead of only ordering by score
+	fair bool
+	// Turn of each submitter with queued songs in fair mode.
+	// The submitter with the lowest turn waited the longest.
+	turns    map[uuid.UUID]uint64
+	nextTurn uint64
+	// Insertion sequence used to break ties between equally ranked songs
+	nextSeq uint64
+	// Songs pinned by admins are played in order before all voted songs
+	pinned []*Song
+	// Songs moved by admins to a fixed position ordered by their position
+	placed []*Song
+}
+
+func NewPlaylist(ranking RankingStrategy) Playlist {
+	return Playlist{ranking: ranking}
+}
+
+func NewFairPlaylist(ranking RankingStrategy) Playlist {
+	return Playlist{ranking: ranking, fair: true, turns: map[uuid.UUID]uint64{}}
+}
 
-func (pl Playlist) Len() int { return len(pl) }
+func (pl Playlist) Len() int { return len(pl.songs) }
 
 func (pl Playlist) Less(i, j int) bool {
-	return pl[i].Weight > pl[j].Weight
+	a, b := pl.songs[i], pl.songs[j]
+	if pl.fair {
+		if a.round != b.round {
+			return a.round < b.round
+		}
+
+		if ta, tb := pl.turns[a.AddedBy], pl.turns[b.AddedBy]; ta != tb {
+			return ta < tb
+		}
+	}
+
+	return rankedBefore(a, b)
+}
+
+// Order songs by score and equally scored songs first in first out
+func rankedBefore(a, b *Song) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.seq < b.seq
 }
 
 func (pl Playlist) Swap(i, j int) {
-	pl[i], pl[j] = pl[j], pl[i]
-	pl[i].index = i
-	pl[j].index = j
+	pl.songs[i], pl.songs[j] = pl.songs[j], pl.songs[i]
+	pl.songs[i].index = i
+	pl.songs[j].index = j
 }
 
 func (pl *Playlist) Push(x any) {
-	n := len(*pl)
+	n := len(pl.songs)
 	song := x.(*Song)
 	song.index = n
-	*pl = append(*pl, song)
+	pl.songs = append(pl.songs, song)
 }
 
 func (pl *Playlist) Pop() any {
-	old := *pl
+	old := pl.songs
 	n := len(old)
 	s := old[n-1]
 	old[n-1] = nil // avoid memory leak
-	*pl = old[0 : n-1]
+	pl.songs = old[0 : n-1]
 	return s
 }
 
+// Update the score of a song using the playlist's ranking strategy.
+// Locked songs keep their score.
+func (pl *Playlist) rank(s *Song) {
+	if s.Locked {
+		return
+	}
+
+	if pl.ranking == nil {
+		pl.ranking = WeightRanking{}
+	}
+	s.Score = pl.ranking.Score(s)
+}
+
 func (pl *Playlist) PopSong() *Song {
-	llog.DDebug("popping song from the playlist (%p) -> %v", pl, pl)
-	if len(*pl) == 0 {
+	llog.DDebug("popping song from the playlist (%p) -> %v", pl, pl.songs)
+	s := pl.Peek()
+	if s != nil {
+		pl.pop(s)
+	}
+	return s
+}
+
+// Remove the song which is played next from the playlist.
+// The songs moved to a fixed position advance by one position.
+func (pl *Playlist) pop(s *Song) {
+	if i := slices.Index(pl.placed, s); i >= 0 {
+		pl.placed = slices.Delete(pl.placed, i, i+1)
+		llog.DDebug("popped moved song %p from the playlist (%p) -> %v", s, pl, pl.placed)
+	} else if s.Pinned {
+		pl.RemoveSong(s)
+		llog.DDebug("popped pinned song %p from the playlist (%p) -> %v", s, pl, pl.pinned)
+	} else {
+		heap.Remove(pl, s.index)
+		llog.DDebug("popped song %p from the playlist (%p) -> %v", s, pl, pl.songs)
+
+		if pl.fair {
+			// The submitter was just served and has to wait for all others
+			delete(pl.turns, s.AddedBy)
+			pl.rotate()
+		}
+	}
+
+	s.Pinned = false
+	s.Position = 0
+	for _, p := range pl.placed {
+		if p.Position > 0 {
+			p.Position--
+		}
+	}
+}
+
+// Return the song PopSong would return without removing it
+func (pl *Playlist) Peek() *Song {
+	// Moved songs are played next if they reached the top or nothing else is queued
+	if len(pl.placed) > 0 && (pl.placed[0].Position == 0 || len(pl.pinned)+pl.Len() == 0) {
+		return pl.placed[0]
+	}
+
+	if len(pl.pinned) > 0 {
+		return pl.pinned[0]
+	}
+
+	if len(pl.songs) == 0 {
 		return nil
 	}
+	return pl.songs[0]
+}
 
-	s := heap.Pop(pl).(*Song)
-	llog.DDebug("popped song %p from the playlist (%p) -> %v", s, pl, pl)
+// Return the first song in play order accepted by the filter or nil
+func (pl *Playlist) PeekFunc(accept func(*Song) bool) *Song {
+	if s := pl.Peek(); s == nil || accept(s) {
+		return s
+	}
+
+	for _, s := range pl.OrderedList() {
+		if accept(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Remove and return the first song in play order accepted by the filter.
+// The songs before it stay queued in their order.
+func (pl *Playlist) PopSongFunc(accept func(*Song) bool) *Song {
+	s := pl.PeekFunc(accept)
+	if s != nil {
+		pl.pop(s)
+	}
 	return s
 }
 
 func (pl *Playlist) Add(s *Song) {
+	pl.nextSeq++
+	s.seq = pl.nextSeq
+	pl.rank(s)
+	if s.Pinned && s.Position > 0 {
+		pl.place(s)
+		return
+	} else if s.Pinned {
+		pl.pinned = append(pl.pinned, s)
+		return
+	}
+
 	heap.Push(pl, s)
-	llog.DDebug("added song %p to the playlist (%p) -> %v", s, pl, pl)
+	llog.DDebug("added song %p to the playlist (%p) -> %v", s, pl, pl.songs)
+	pl.rotate()
 }
 
 func (pl *Playlist) Adjust(s *Song) {
+	pl.rank(s)
+	if s.Pinned {
+		return
+	}
+
 	heap.Fix(pl, s.index)
-	llog.DDebug("adjusting song %p in the playlist (%p) -> %v", s, pl, pl)
+	llog.DDebug("adjusting song %p in the playlist (%p) -> %v", s, pl, pl.songs)
+	pl.rotate()
 }
 
 func (pl *Playlist) RemoveSong(s *Song) {
+	if s.Pinned {
+		if i := slices.Index(pl.pinned, s); i >= 0 {
+			pl.pinned = slices.Delete(pl.pinned, i, i+1)
+		} else if i := slices.Index(pl.placed, s); i >= 0 {
+			pl.placed = slices.Delete(pl.placed, i, i+1)
+		}
+		return
+	}
+
 	heap.Remove(pl, s.index)
-	llog.DDebug("removing song %p in the playlist (%p) -> %v", s, pl, pl)
+	llog.DDebug("removing song %p in the playlist (%p) -> %v", s, pl, pl.songs)
+	pl.rotate()
+}
+
+// Recompute the scores of all songs and restore the heap order
+func (pl *Playlist) Rerank() {
+	for _, s := range pl.pinned {
+		pl.rank(s)
+	}
+	for _, s := range pl.placed {
+		pl.rank(s)
+	}
+	for _, s := range pl.songs {
+		pl.rank(s)
+	}
+	heap.Init(pl)
+	pl.rotate()
+}
+
+// Assign each song its round in fair mode and restore the heap order.
+// The songs of each submitter are ordered by score and the n-th song of each
+// submitter is played in the n-th round.
+func (pl *Playlist) rotate() {
+	if !pl.fair {
+		return
+	}
+
+	bySubmitter := map[uuid.UUID][]*Song{}
+	for _, s := range pl.songs {
+		bySubmitter[s.AddedBy] = append(bySubmitter[s.AddedBy], s)
+	}
+
+	// Forget the turns of submitters without queued songs
+	for submitter := range pl.turns {
+		if _, ok := bySubmitter[submitter]; !ok {
+			delete(pl.turns, submitter)
+		}
+	}
+
+	for submitter, songs := range bySubmitter {
+		if _, ok := pl.turns[submitter]; !ok {
+			pl.turns[submitter] = pl.nextTurn
+			pl.nextTurn++
+		}
+
+		sort.Slice(songs, func(i, j int) bool { return rankedBefore(songs[i], songs[j]) })
+		for round, s := range songs {
+			s.round = round
+		}
+	}
+
+	heap.Init(pl)
+}
+
+// Return the number of queued songs including the pinned and moved ones
+func (pl *Playlist) Queued() int {
+	return len(pl.pinned) + len(pl.placed) + pl.Len()
+}
+
+// Report if the songs are played in the order of their scores
+func (pl *Playlist) scoreOrdered() bool {
+	return !pl.fair && len(pl.pinned) == 0 && len(pl.placed) == 0
+}
+
+// Pin a song to play after the already pinned songs
+func (pl *Playlist) Pin(s *Song) {
+	if s.Pinned {
+		return
+	}
+
+	heap.Remove(pl, s.index)
+	s.Pinned = true
+	pl.pinned = append(pl.pinned, s)
+	pl.rotate()
+}
+
+// Return a pinned song to the voted songs
+func (pl *Playlist) Unpin(s *Song) {
+	if !s.Pinned {
+		return
+	}
+
+	pl.RemoveSong(s)
+	s.Pinned = false
+	s.Position = 0
+	pl.rank(s)
+	heap.Push(pl, s)
+	pl.rotate()
+}
+
+// Move a song to a position in the play order.
+// Only the moved song is pinned to its position, which advances as songs are played.
+// The other songs keep being ordered by their votes around it.
+func (pl *Playlist) Move(s *Song, position int) {
+	pl.Unpin(s)
+	heap.Remove(pl, s.index)
+
+	if queued := pl.Queued(); position > queued {
+		position = queued
+	} else if position < 0 {
+		position = 0
+	}
+
+	s.Pinned = true
+	if position <= len(pl.pinned) {
+		pl.pinned = slices.Insert(pl.pinned, position, s)
+	} else {
+		s.Position = position
+		pl.place(s)
+	}
+	pl.rotate()
+}
+
+// Insert a moved song before the moved songs with the same or a later position
+func (pl *Playlist) place(s *Song) {
+	i := sort.Search(len(pl.placed), func(i int) bool { return pl.placed[i].Position >= s.Position })
+	pl.placed = slices.Insert(pl.placed, i, s)
 }
 
 func (pl *Playlist) OrderedList() []*Song {
-	songs := make([]*Song, 0, pl.Len())
+	songs := make([]*Song, 0, pl.Queued())
+	songs = append(songs, pl.pinned...)
 
-	cpy := make(Playlist, pl.Len())
-	copy(cpy, *pl)
-	llog.DDebug("copying %v returned %v", *pl, cpy)
+	cpy := Playlist{songs: make([]*Song, pl.Len()), ranking: pl.ranking, fair: pl.fair, turns: pl.turns}
+	copy(cpy.songs, pl.songs)
+	llog.DDebug("copying %v returned %v", pl.songs, cpy.songs)
 
 	for cpy.Len() > 0 {
 		songs = append(songs, heap.Pop(&cpy).(*Song))
 	}
 
+	// The placed songs are ordered by their position
+	for _, s := range pl.placed {
+		i := s.Position
+		if i > len(songs) {
+			i = len(songs)
+		}
+		songs = slices.Insert(songs, i, s)
+	}
+
 	// TODO: Use more efficiently traversable data structure
 	llog.DDebug("fix song indices in pl")
-	for i, s := range *pl {
+	for i, s := range pl.songs {
 		s.index = i
 	}
 
-	llog.DDebug("ordering queue %v returned %v", pl, songs)
+	llog.DDebug("ordering queue %v returned %v", pl.songs, songs)
 	return songs
 }
 
 func (pl *Playlist) applyTimeBonus(timeBonus float64) {
-	for _, s := range *pl {
+	for _, s := range pl.songs {
 		s.Weight += timeBonus
 		llog.DDebug("%p %v", s, s.Weight)
 	}
-	heap.Init(pl)
-	llog.DDebug("applying time bonus to the playlist %v", *pl)
+	pl.Rerank()
+	llog.DDebug("applying time bonus to the playlist %v", pl.songs)
+}
+
+// Grant each song a bonus proportional to the time it waited since last
+func (pl *Playlist) applyWaitBonus(bonusPerMinute float64, last, now time.Time) {
+	for _, s := range pl.songs {
+		since := last
+		if s.Added.After(since) {
+			since = s.Added
+		}
+		s.Weight += bonusPerMinute * now.Sub(since).Minutes()
+	}
+	pl.Rerank()
+	llog.DDebug("applying wait bonus to the playlist %v", pl.songs)
 }
@@ -1,12 +1,16 @@
 package main
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
 
 func TestPlAdd(t *testing.T) {
 	var pl Playlist
 	s := NewDummySong("Foo", "Bar")
 	pl.Add(s)
-	if len(pl) != 1 {
+	if pl.Len() != 1 {
 		t.Log("len should be 1")
 		t.Fail()
 	}
@@ -16,13 +20,13 @@ func TestPlAddPop(t *testing.T) {
 	var pl Playlist
 	s := NewDummySong("Foo", "Bar")
 	pl.Add(s)
-	if len(pl) != 1 {
+	if pl.Len() != 1 {
 		t.Log("len should be 1")
 		t.Fail()
 	}
 
 	ps := pl.PopSong()
-	if len(pl) != 0 {
+	if pl.Len() != 0 {
 		t.Log("len should be 0")
 		t.Fail()
 	}
@@ -39,14 +43,14 @@ func TestPlAddPopTwice(t *testing.T) {
 	s2 := NewDummySong("Nasen", "Baer")
 	pl.Add(s1)
 	pl.Add(s2)
-	if len(pl) != 2 {
+	if pl.Len() != 2 {
 		t.Log("len should be 2")
 		t.Fail()
 	}
 
 	ps1 := pl.PopSong()
 	ps2 := pl.PopSong()
-	if len(pl) != 0 {
+	if pl.Len() != 0 {
 		t.Log("len should be 0")
 		t.Fail()
 	}
@@ -68,7 +72,7 @@ func TestPlAdd2AdjustPop(t *testing.T) {
 	s2 := NewDummySong("Nasen", "Baer")
 	pl.Add(s1)
 	pl.Add(s2)
-	if len(pl) != 2 {
+	if pl.Len() != 2 {
 		t.Log("len should be 2")
 		t.Fail()
 	}
@@ -77,7 +81,7 @@ func TestPlAdd2AdjustPop(t *testing.T) {
 	pl.Adjust(s2)
 
 	ps := pl.PopSong()
-	if len(pl) != 1 {
+	if pl.Len() != 1 {
 		t.Log("len should be 1")
 		t.Fail()
 	}
@@ -97,7 +101,7 @@ func TestPlAdd3AdjustAdjustPop(t *testing.T) {
 	pl.Add(s2)
 	pl.Add(s3)
 
-	if len(pl) != 3 {
+	if pl.Len() != 3 {
 		t.Log("len should be 3")
 		t.Fail()
 	}
@@ -112,7 +116,7 @@ func TestPlAdd3AdjustAdjustPop(t *testing.T) {
 	pl.Adjust(s3)
 
 	ps := pl.PopSong()
-	if len(pl) != 2 {
+	if pl.Len() != 2 {
 		t.Log("len should be 2")
 		t.Fail()
 	}
@@ -123,7 +127,7 @@ func TestPlAdd3AdjustAdjustPop(t *testing.T) {
 	}
 
 	ps = pl.PopSong()
-	if len(pl) != 1 {
+	if pl.Len() != 1 {
 		t.Log("len should be 1")
 		t.Fail()
 	}
@@ -139,11 +143,11 @@ func TestPlOrderedList(t *testing.T) {
 	s := NewDummySong("Foo", "Bar")
 	pl.Add(s)
 	l := pl.OrderedList()
-	if len(pl) != len(l) {
+	if pl.Len() != len(l) {
 		t.Log("size of pl and ordered list differs")
 		t.Fail()
 	}
-	if pl[0] != l[0] {
+	if pl.songs[0] != l[0] {
 		t.Log("element of pl and ordered list differs")
 		t.Fail()
 	}
@@ -156,3 +160,212 @@ func TestRemoveAfterOrderedList(t *testing.T) {
 	pl.OrderedList()
 	pl.RemoveSong(s)
 }
+
+func TestPlWilsonRanking(t *testing.T) {
+	pl := NewPlaylist(WilsonRanking{})
+	s1 := NewDummySong("Foo", "Bar")
+	s2 := NewDummySong("Nasen", "Baer")
+
+	// s1: one upvote
+	s1.Upvotes[uuid.New()] = struct{}{}
+
+	// s2: ten upvotes and one downvote
+	for i := 0; i < 10; i++ {
+		s2.Upvotes[uuid.New()] = struct{}{}
+	}
+	s2.Downvotes[uuid.New()] = struct{}{}
+
+	pl.Add(s1)
+	pl.Add(s2)
+
+	if ps := pl.PopSong(); ps != s2 {
+		t.Logf("the song with more evidence of being liked should be popped first not %v", ps)
+		t.Fail()
+	}
+}
+
+func TestPlScoreRankingIgnoresWeight(t *testing.T) {
+	pl := NewPlaylist(ScoreRanking{})
+	s1 := NewDummySong("Foo", "Bar")
+	s2 := NewDummySong("Nasen", "Baer")
+	pl.Add(s1)
+	pl.Add(s2)
+
+	s1.Weight += 10
+	pl.Adjust(s1)
+
+	s2.Upvotes[uuid.New()] = struct{}{}
+	pl.Adjust(s2)
+
+	if ps := pl.PopSong(); ps != s2 {
+		t.Logf("the upvoted song should be popped first not %v", ps)
+		t.Fail()
+	}
+}
+
+func TestPlFairRotation(t *testing.T) {
+	pl := NewFairPlaylist(WeightRanking{})
+	alice, _ := uuid.NewRandom()
+	bob, _ := uuid.NewRandom()
+
+	add := func(title string, submitter uuid.UUID, weight float64) *Song {
+		s := NewDummySong(title, "Bar")
+		s.AddedBy = submitter
+		s.Weight = weight
+		pl.Add(s)
+		return s
+	}
+
+	a1 := add("a1", alice, 0)
+	a2 := add("a2", alice, 5)
+	a3 := add("a3", alice, -1)
+	b1 := add("b1", bob, 0)
+
+	expected := []*Song{a2, b1, a1, a3}
+	ordered := pl.OrderedList()
+	for i, s := range expected {
+		if ordered[i] != s {
+			t.Fatalf("ordered list %v does not rotate between submitters", ordered)
+		}
+	}
+
+	if ps := pl.PopSong(); ps != a2 {
+		t.Fatalf("popped %v instead of alice's best song", ps)
+	}
+
+	// Alice was just served and bob's new song outranks his queued one
+	b2 := add("b2", bob, 10)
+	expected = []*Song{b2, a1, b1, a3}
+	for i, s := range expected {
+		if ps := pl.PopSong(); ps != s {
+			t.Fatalf("popped %v at %d instead of %v", ps, i, s)
+		}
+	}
+}
+
+func assertPlSequence(t *testing.T, pl *Playlist, expected []*Song) {
+	t.Helper()
+	ordered := pl.OrderedList()
+	if len(ordered) != len(expected) {
+		t.Fatalf("ordered list %v should contain %d songs", ordered, len(expected))
+	}
+
+	for i, s := range expected {
+		if ordered[i] != s {
+			t.Fatalf("ordered list %v differs from %v at %d", ordered, expected, i)
+		}
+	}
+
+	for i, s := range expected {
+		if ps := pl.PopSong(); ps != s {
+			t.Fatalf("popped %v at %d instead of %v", ps, i, s)
+		}
+	}
+}
+
+func TestPlFifoTieBreak(t *testing.T) {
+	var pl Playlist
+	var songs []*Song
+	for _, title := range []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7"} {
+		s := NewDummySong(title, "Bar")
+		pl.Add(s)
+		songs = append(songs, s)
+	}
+
+	assertPlSequence(t, &pl, songs)
+}
+
+func TestPlFifoTieBreakAfterAdjust(t *testing.T) {
+	var pl Playlist
+	s1 := NewDummySong("s1", "Bar")
+	s2 := NewDummySong("s2", "Bar")
+	s3 := NewDummySong("s3", "Bar")
+	s4 := NewDummySong("s4", "Bar")
+	for _, s := range []*Song{s1, s2, s3, s4} {
+		pl.Add(s)
+	}
+
+	s3.Weight = 1
+	pl.Adjust(s3)
+	s3.Weight = 0
+	pl.Adjust(s3)
+	s2.Weight = -1
+	pl.Adjust(s2)
+
+	assertPlSequence(t, &pl, []*Song{s1, s3, s4, s2})
+}
+
+func TestPlPinMoveLock(t *testing.T) {
+	var pl Playlist
+	s1 := NewDummySong("s1", "Bar")
+	s2 := NewDummySong("s2", "Bar")
+	s3 := NewDummySong("s3", "Bar")
+	s4 := NewDummySong("s4", "Bar")
+	s5 := NewDummySong("s5", "Bar")
+	for _, s := range []*Song{s1, s2, s3, s4, s5} {
+		pl.Add(s)
+	}
+
+	pl.Pin(s4)
+	pl.Move(s5, 2)
+
+	// Locked songs are not moved by votes
+	s1.Weight = -5
+	pl.Adjust(s1)
+	s3.Locked = true
+	s3.Weight = 10
+	pl.Adjust(s3)
+	s2.Weight = 1
+	pl.Adjust(s2)
+
+	if !s4.Pinned || !s5.Pinned || s1.Pinned || s2.Pinned {
+		t.Fatal("Moving a song pinned other songs than the moved one")
+	}
+
+	// Songs added later can still get ahead of the moved song
+	s6 := NewDummySong("s6", "Bar")
+	s6.Weight = 2
+	pl.Add(s6)
+
+	assertPlSequence(t, &pl, []*Song{s4, s6, s5, s2, s3, s1})
+}
+
+func TestPlUnpin(t *testing.T) {
+	var pl Playlist
+	s1 := NewDummySong("s1", "Bar")
+	s2 := NewDummySong("s2", "Bar")
+	s3 := NewDummySong("s3", "Bar")
+	for _, s := range []*Song{s1, s2, s3} {
+		pl.Add(s)
+	}
+
+	pl.Pin(s3)
+	pl.Pin(s2)
+	pl.Unpin(s3)
+	if pl.scoreOrdered() {
+		t.Fatal("Playlist with a pinned song is ordered by score")
+	}
+
+	assertPlSequence(t, &pl, []*Song{s2, s1, s3})
+}
+
+func TestPlPopSongFunc(t *testing.T) {
+	var pl Playlist
+	s1 := NewSong("s1", "Bar", "broken", "1")
+	s2 := NewDummySong("s2", "Bar")
+	s3 := NewSong("s3", "Bar", "broken", "3")
+	for _, s := range []*Song{s1, s2, s3} {
+		pl.Add(s)
+	}
+	pl.Pin(s3)
+
+	playable := func(s *Song) bool { return s.Source != "broken" }
+	if ps := pl.PopSongFunc(playable); ps != s2 {
+		t.Fatalf("Popped %v instead of the first accepted song", ps)
+	}
+	if ps := pl.PopSongFunc(playable); ps != nil {
+		t.Fatalf("Popped %v although no song is accepted", ps)
+	}
+
+	assertPlSequence(t, &pl, []*Song{s3, s1})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"muhq.space/go/wrms/llog"
+)
+
+// Songs prefetched by a backend while they wait at the top of the queue
+type prefetchCache[T any] struct {
+	lock    sync.Mutex
+	entries map[*Song]*prefetchEntry[T]
+	// Free a prefetched value which is no longer needed
+	release func(T)
+}
+
+type prefetchEntry[T any] struct {
+	// Closed when fetching finished
+	done   chan struct{}
+	cancel context.CancelFunc
+	value  T
+	err    error
+}
+
+func newPrefetchCache[T any](release func(T)) *prefetchCache[T] {
+	return &prefetchCache[T]{entries: map[*Song]*prefetchEntry[T]{}, release: release}
+}
+
+// Fetch the song in the background unless it is already prefetched
+func (c *prefetchCache[T]) Start(song *Song, fetch func(ctx context.Context) (T, error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[song]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &prefetchEntry[T]{done: make(chan struct{}), cancel: cancel}
+	c.entries[song] = entry
+
+	go func() {
+		entry.value, entry.err = fetch(ctx)
+		close(entry.done)
+	}()
+}
+
+// Remove the prefetched value of the song from the cache and return it.
+// Take waits for a running fetch and reports false if the song was not prefetched
+// or fetching it failed.
+func (c *prefetchCache[T]) Take(song *Song) (value T, ok bool) {
+	c.lock.Lock()
+	entry, ok := c.entries[song]
+	delete(c.entries, song)
+	c.lock.Unlock()
+
+	if !ok {
+		return value, false
+	}
+
+	<-entry.done
+	entry.cancel()
+
+	if entry.err != nil {
+		llog.Warning("Prefetching %v failed: %v", song, entry.err)
+		return value, false
+	}
+	return entry.value, true
+}
+
+// Cancel fetching the song and release everything already fetched
+func (c *prefetchCache[T]) Discard(song *Song) {
+	c.lock.Lock()
+	entry, ok := c.entries[song]
+	delete(c.entries, song)
+	c.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	llog.Debug("Discarding the prefetched %v", song)
+	entry.cancel()
+
+	go func() {
+		<-entry.done
+		if entry.err == nil && c.release != nil {
+			c.release(entry.value)
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"muhq.space/go/wrms/llog"
+)
+
+const DEFAULT_PROGRESS_INTERVAL = 15 * time.Second
+
+var ErrNotPlaying = errors.New("nothing is playing")
+
+// Playback progress of the current song in seconds
+type Progress struct {
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration,omitempty"`
+	Paused   bool    `json:"paused,omitempty"`
+}
+
+// Track the current song as played from its beginning.
+// The rwlock must be held when calling _startProgress.
+func (wrms *Wrms) _startProgress() {
+	wrms.startedAt = time.Now()
+	wrms.pausedAt = time.Time{}
+	wrms.reportedDuration = 0
+}
+
+// The rwlock must be held when calling _pauseProgress.
+func (wrms *Wrms) _pauseProgress() {
+	if !wrms.startedAt.IsZero() && wrms.pausedAt.IsZero() {
+		wrms.pausedAt = time.Now()
+	}
+}
+
+// Move the start of the current song by the time it was paused.
+// The rwlock must be held when calling _resumeProgress.
+func (wrms *Wrms) _resumeProgress() {
+	if wrms.pausedAt.IsZero() {
+		return
+	}
+	wrms.startedAt = wrms.startedAt.Add(time.Since(wrms.pausedAt))
+	wrms.pausedAt = time.Time{}
+}
+
+// The rwlock must be held when calling _stopProgress.
+func (wrms *Wrms) _stopProgress() {
+	wrms.startedAt = time.Time{}
+	wrms.pausedAt = time.Time{}
+	wrms.reportedDuration = 0
+}
+
+// Return the progress of the current song or nil if there is no current song.
+// The rwlock must be held when calling _progress.
+func (wrms *Wrms) _progress() *Progress {
+	song := wrms.CurrentSong.Load()
+	if song == nil {
+		return nil
+	}
+
+	p := &Progress{Duration: song.Duration, Paused: !wrms.playing}
+	if wrms.reportedDuration > 0 {
+		p.Duration = wrms.reportedDuration
+	}
+
+	switch {
+	case wrms.startedAt.IsZero():
+		// The song was not started yet
+	case !wrms.pausedAt.IsZero():
+		p.Position = wrms.pausedAt.Sub(wrms.startedAt).Seconds()
+	default:
+		p.Position = time.Since(wrms.startedAt).Seconds()
+	}
+
+	return p
+}
+
+// Attach the progress of the current song to an event.
+// Events of a playing song also carry the time the song started.
+// The rwlock must be held when calling _addProgress.
+func (wrms *Wrms) _addProgress(ev *Event) {
+	ev.Progress = wrms._progress()
+	if ev.Progress != nil && !ev.Progress.Paused && !wrms.startedAt.IsZero() {
+		startedAt := wrms.startedAt
+		ev.StartedAt = &startedAt
+	}
+}
+
+// Adopt the progress reported by the player which includes loading delays and seeking
+func (wrms *Wrms) syncProgress() {
+	wrms.rwlock.RLock()
+	song := wrms.CurrentSong.Load()
+	wrms.rwlock.RUnlock()
+
+	if song == nil {
+		return
+	}
+
+	// Do not block the rwlock while the player is queried
+	reported, err := wrms.Player.Progress()
+	if err != nil {
+		llog.Debug("Querying the player progress failed: %v", err)
+		return
+	}
+
+	wrms.rwlock.Lock()
+	defer wrms.rwlock.Unlock()
+
+	// The song changed meanwhile or was never started
+	if wrms.CurrentSong.Load() != song || wrms.startedAt.IsZero() {
+		return
+	}
+
+	position := time.Duration(reported.Position * float64(time.Second))
+	if wrms.pausedAt.IsZero() {
+		wrms.startedAt = time.Now().Add(-position)
+	} else {
+		wrms.startedAt = wrms.pausedAt.Add(-position)
+	}
+	wrms.reportedDuration = reported.Duration
+}
+
+// Broadcast the progress of the current song
+func (wrms *Wrms) BroadcastProgress() {
+	wrms.syncProgress()
+
+	wrms.rwlock.RLock()
+	if wrms.CurrentSong.Load() == nil || !wrms.playing {
+		wrms.rwlock.RUnlock()
+		return
+	}
+
+	ev := wrms.newEvent("progress", []*Song{wrms.CurrentSong.Load()})
+	wrms._addProgress(&ev)
+	wrms.rwlock.RUnlock()
+
+	wrms.Broadcast(ev)
+}
+
+// Let the clients correct their position estimates regularly
+func (wrms *Wrms) broadcastProgressPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		wrms.BroadcastProgress()
+	}
+}
+
+// Send the progress of the current song only to a single connection
+func (wrms *Wrms) sendProgress(conn *Connection) {
+	wrms.syncProgress()
+
+	wrms.rwlock.RLock()
+	var songs []*Song
+	if song := wrms.CurrentSong.Load(); song != nil {
+		songs = []*Song{song}
+	}
+	ev := wrms.newPrivateEvent(0, "progress", songs)
+	wrms._addProgress(&ev)
+	wrms.rwlock.RUnlock()
+
+	conn.Send(ev)
+}
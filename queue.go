@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+
+	"muhq.space/go/wrms/llog"
+)
+
+var ErrNotQueued = errors.New("song is not queued")
+
+// Apply an admin change of the queue position to a queued song and announce it
+func (wrms *Wrms) reorderSong(songId string, change func(*Song)) error {
+	wrms.rwlock.Lock()
+
+	i := wrms._songIndex(songId)
+	if i < 0 {
+		wrms.rwlock.Unlock()
+		return ErrNotQueued
+	}
+
+	s := wrms.Songs[i]
+	change(s)
+	wrms.saveState()
+
+	ev := wrms._newReorderEvent([]*Song{s})
+	wrms._prefetchNext()
+	wrms.rwlock.Unlock()
+
+	wrms.Broadcast(ev)
+	return nil
+}
+
+// Play the song after the already pinned songs
+func (wrms *Wrms) PinSong(songId string) error {
+	llog.Info("Pin song %s", songId)
+	return wrms.reorderSong(songId, wrms.queue.Pin)
+}
+
+// Return the song to the voted songs
+func (wrms *Wrms) UnpinSong(songId string) error {
+	llog.Info("Unpin song %s", songId)
+	return wrms.reorderSong(songId, wrms.queue.Unpin)
+}
+
+// Move the song to a position in the queue.
+// Only the moved song is pinned to keep its position.
+func (wrms *Wrms) MoveSong(songId string, position int) error {
+	llog.Info("Move song %s to position %d", songId, position)
+	return wrms.reorderSong(songId, func(s *Song) {
+		wrms.queue.Move(s, position)
+	})
+}
+
+// Lock or unlock the score of a song against votes
+func (wrms *Wrms) LockSong(songId string, locked bool) error {
+	llog.Info("Set locked of song %s to %v", songId, locked)
+	return wrms.reorderSong(songId, func(s *Song) {
+		s.Locked = locked
+		wrms.queue.Adjust(s)
+	})
+}
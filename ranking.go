@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A RankingStrategy determines the order of the songs in the Playlist.
+// Songs with a higher score are played first.
+type RankingStrategy interface {
+	Score(s *Song) float64
+}
+
+const DEFAULT_RANKING = "weight"
+
+func NewRankingStrategy(name string) (RankingStrategy, error) {
+	switch name {
+	case "", "weight":
+		return WeightRanking{}, nil
+	case "score":
+		return ScoreRanking{}, nil
+	case "wilson":
+		return WilsonRanking{}, nil
+	case "hot":
+		return HotRanking{}, nil
+	default:
+		return nil, fmt.Errorf("unknown ranking strategy %s", name)
+	}
+}
+
+// Rank songs by their weight consisting of their votes and the time bonus
+type WeightRanking struct{}
+
+func (WeightRanking) Score(s *Song) float64 { return s.Weight }
+
+// Rank songs by the difference of up- and downvotes
+type ScoreRanking struct{}
+
+func (ScoreRanking) Score(s *Song) float64 {
+	return float64(len(s.Upvotes) - len(s.Downvotes))
+}
+
+// Rank songs by the lower bound of the Wilson score confidence interval
+// of the fraction of upvotes.
+type WilsonRanking struct{}
+
+// z-score of a 95% confidence
+const WILSON_Z = 1.96
+
+func (WilsonRanking) Score(s *Song) float64 {
+	ups := float64(len(s.Upvotes))
+	n := ups + float64(len(s.Downvotes))
+	if n == 0 {
+		return 0
+	}
+
+	p := ups / n
+	z2 := WILSON_Z * WILSON_Z
+	return (p + z2/(2*n) - WILSON_Z*math.Sqrt((p*(1-p)+z2/(4*n))/n)) / (1 + z2/n)
+}
+
+// Rank songs like reddit ranks its "hot" posts.
+// The votes count logarithmically and the score of older songs decays
+// compared to newly added ones.
+type HotRanking struct{}
+
+// Epoch used by reddit
+const HOT_EPOCH = 1134028003
+
+// Seconds a song must be younger to outweigh ten times the votes
+const HOT_DECAY = 45000
+
+func (HotRanking) Score(s *Song) float64 {
+	score := float64(len(s.Upvotes) - len(s.Downvotes))
+	order := math.Log10(math.Max(math.Abs(score), 1))
+
+	sign := 0.0
+	if score > 0 {
+		sign = 1
+	} else if score < 0 {
+		sign = -1
+	}
+
+	seconds := float64(s.Added.Unix() - HOT_EPOCH)
+	return sign*order + seconds/HOT_DECAY
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"muhq.space/go/wrms/llog"
+)
+
+// The room served at the root of the server
+const DEFAULT_ROOM = "default"
+
+var roomNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Rooms are independent Wrms instances served under /r/<room>/
+type Rooms struct {
+	// The configuration new rooms inherit from
+	config Config
+	lock   sync.RWMutex
+	rooms  map[string]*Wrms
+	// Serves the default room at / and the other rooms under /r/<room>/
+	mux *http.ServeMux
+	// Create the player of a new room
+	newPlayer func(wrms *Wrms) Player
+}
+
+func NewRooms(config Config) *Rooms {
+	return newRooms(config, func(wrms *Wrms) Player {
+		return NewMpvPlayer(wrms, wrms.Config.Backends)
+	})
+}
+
+func newRooms(config Config, newPlayer func(wrms *Wrms) Player) *Rooms {
+	rooms := &Rooms{config: config, rooms: map[string]*Wrms{},
+		mux: http.NewServeMux(), newPlayer: newPlayer}
+
+	defaultConfig, err := config.roomConfig(DEFAULT_ROOM, config.Rooms[DEFAULT_ROOM])
+	if err != nil {
+		llog.Fatal("Failed to parse the configuration of room %s: %v", DEFAULT_ROOM, err)
+	}
+	// The default room keeps the top-level admins and playlists
+	defaultConfig.Admins = append(defaultConfig.Admins, config.Admins...)
+	defaultConfig.Playlists = append(defaultConfig.Playlists, config.Playlists...)
+
+	defaultRoom, _ := rooms.addRoom(DEFAULT_ROOM, defaultConfig)
+	rooms.mux.Handle("/", defaultRoom.mux)
+
+	for name, node := range config.Rooms {
+		if name == DEFAULT_ROOM {
+			continue
+		}
+
+		roomConfig, err := config.roomConfig(name, node)
+		if err != nil {
+			llog.Fatal("Failed to parse the configuration of room %s: %v", name, err)
+		}
+
+		if _, err := rooms.addRoom(name, roomConfig); err != nil {
+			llog.Fatal("Failed to create room %s: %v", name, err)
+		}
+	}
+
+	rooms.mux.HandleFunc("/rooms", rooms.roomsHandler)
+	return rooms
+}
+
+func (rooms *Rooms) addRoom(name string, config Config) (*Wrms, error) {
+	if !roomNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid room name %q", name)
+	}
+
+	rooms.lock.Lock()
+	defer rooms.lock.Unlock()
+
+	if _, ok := rooms.rooms[name]; ok {
+		return nil, fmt.Errorf("room %s already exists", name)
+	}
+
+	llog.Info("Creating room %s", name)
+	room := NewWrms(name, config, rooms.newPlayer)
+	rooms.rooms[name] = room
+
+	prefix := "/r/" + name
+	rooms.mux.Handle(prefix+"/", http.StripPrefix(prefix, room.mux))
+	return room, nil
+}
+
+func (rooms *Rooms) Get(name string) *Wrms {
+	rooms.lock.RLock()
+	defer rooms.lock.RUnlock()
+	return rooms.rooms[name]
+}
+
+// List all rooms or create a new room
+func (rooms *Rooms) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rooms.lock.RLock()
+		names := make([]string, 0, len(rooms.rooms))
+		for name := range rooms.rooms {
+			names = append(names, name)
+		}
+		rooms.lock.RUnlock()
+
+		data, err := json.Marshal(names)
+		if err != nil {
+			http.Error(w, "Encoding the rooms failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", data)
+		return
+	}
+
+	connId, err := getConnId(w, r)
+	if err != nil {
+		return
+	}
+
+	if !rooms.Get(DEFAULT_ROOM).Config.IsAdmin(connId) {
+		http.Error(w, "Only admins are allowed to create rooms", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	config, err := rooms.config.roomConfig(name, yaml.Node{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The creator administrates the new room
+	config.Admins = append(config.Admins, connId)
+
+	if _, err := rooms.addRoom(name, config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "Created room %s", name)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"muhq.space/go/wrms/llog"
+
+	"github.com/google/uuid"
+)
+
+type SkipVotes struct {
+	Votes  int `json:"votes"`
+	Needed int `json:"needed"`
+}
+
+func (wrms *Wrms) connectionCount() int {
+	n := 0
+	wrms.Connections.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Number of votes needed to skip the current song.
+// A threshold below 1 is the fraction of the connected clients.
+func (wrms *Wrms) skipVotesNeeded() int {
+	threshold := wrms.Config.SkipThreshold
+	if threshold >= 1 {
+		return int(threshold)
+	}
+
+	needed := int(math.Ceil(threshold * float64(wrms.connectionCount())))
+	if needed < 1 {
+		return 1
+	}
+	return needed
+}
+
+// The rwlock must be held when calling _skipVotes.
+func (wrms *Wrms) _skipVotes() *SkipVotes {
+	return &SkipVotes{Votes: len(wrms.skipVotes), Needed: wrms.skipVotesNeeded()}
+}
+
+func (wrms *Wrms) newSkipVotesEvent() Event {
+	ev := wrms.newEvent("skipvotes", nil)
+	ev.SkipVotes = wrms._skipVotes()
+	return ev
+}
+
+// Vote to skip the current song and skip it if enough connections voted
+func (wrms *Wrms) VoteSkip(connId uuid.UUID) error {
+	if wrms.Config.SkipThreshold <= 0 {
+		return errors.New("Skipping songs by vote is disabled")
+	}
+
+	wrms.rwlock.Lock()
+
+	if wrms.CurrentSong.Load() == nil {
+		wrms.rwlock.Unlock()
+		return errors.New("There is no song to skip")
+	}
+
+	if _, ok := wrms.skipVotes[connId]; ok {
+		wrms.rwlock.Unlock()
+		return errors.New("Already voted to skip the current song")
+	}
+
+	if wrms.skipVotes == nil {
+		wrms.skipVotes = map[uuid.UUID]struct{}{}
+	}
+	wrms.skipVotes[connId] = struct{}{}
+
+	ev := wrms.newSkipVotesEvent()
+	llog.Info("%s voted to skip the current song: %v", connId, ev.SkipVotes)
+	wrms._broadcast(ev)
+
+	if ev.SkipVotes.Votes < ev.SkipVotes.Needed {
+		wrms.unlock()
+		return nil
+	}
+
+	llog.Info("Skipping the current song by vote")
+	// _skip() releases the rwlock
+	wrms._skip()
+	return nil
+}
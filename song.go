@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 
 	"muhq.space/go/wrms/llog"
 
@@ -9,14 +10,27 @@ import (
 )
 
 type Song struct {
+	Id        string                 `json:"id"` // identifies the entry in the queue
 	Title     string                 `json:"title"`
 	Artist    string                 `json:"artist"`
 	Source    string                 `json:"source"`
 	Uri       string                 `json:"uri"`
 	Weight    float64                `json:"weight"`
+	Score     float64                `json:"score"` // computed by the RankingStrategy
+	Added     time.Time              `json:"added"`
+	Autofill  string                 `json:"autofill,omitempty"` // source of autofilled songs
+	AddedBy   uuid.UUID              `json:"-"`                  // never revealed to clients
+	Nickname  string                 `json:"nickname,omitempty"` // display name of the submitter
 	Album     string                 `json:"album"`
 	Year      int                    `json:"year"`
-	index     int                    `json:"-"` // used by heap.Interface
+	Duration  float64                `json:"duration,omitempty"` // in seconds, 0 if unknown
+	Isrc      string                 `json:"isrc,omitempty"`     // International Standard Recording Code
+	Pinned    bool                   `json:"pinned,omitempty"`   // played before all voted songs
+	Position  int                    `json:"position,omitempty"` // fixed queue position of moved songs
+	Locked    bool                   `json:"locked,omitempty"`   // score is not changed by votes
+	index     int                    `json:"-"`                  // used by heap.Interface
+	round     int                    `json:"-"`                  // used by fair playlists
+	seq       uint64                 `json:"-"`                  // insertion order in the playlist
 	Upvotes   map[uuid.UUID]struct{} `json:"upvotes"`
 	Downvotes map[uuid.UUID]struct{} `json:"downvotes"`
 }
@@ -47,7 +61,19 @@ func NewSongFromJson(data []byte) (*Song, error) {
 		return nil, err
 	}
 
+	// Queue entry ids, the queue position and the time added are only controlled by the server
+	s.Id = ""
+	s.Added = time.Time{}
+	s.Autofill = ""
+	s.Pinned = false
+	s.Position = 0
+	s.Locked = false
 	s.Upvotes = map[uuid.UUID]struct{}{}
 	s.Downvotes = map[uuid.UUID]struct{}{}
 	return &s, nil
 }
+
+// Return the canonical identifier of the song namespaced by its source
+func (s *Song) Key() string {
+	return s.Source + ":" + s.Uri
+}
@@ -8,8 +8,10 @@ package main
 // Copyright (c) 2018 Guillaume "xplodwild" Lesniak
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strings"
@@ -37,12 +39,15 @@ type SpotifyBackend struct {
 	session                *core.Session
 	searchResults          int
 	displayedSearchResults int
+	// Tracks loaded while they wait at the top of the queue
+	prefetched *prefetchCache[io.Reader]
 }
 
 func NewSpotify(config *SpotifyConfig) (*SpotifyBackend, error) {
 	spotify := SpotifyBackend{
 		searchResults:          searchResults,
-		displayedSearchResults: displayedSearchResults}
+		displayedSearchResults: displayedSearchResults,
+		prefetched:             newPrefetchCache(releaseAudioFile)}
 
 	if config == nil {
 		config = &SpotifyConfig{}
@@ -71,9 +76,50 @@ func NewSpotify(config *SpotifyConfig) (*SpotifyBackend, error) {
 	return &spotify, nil
 }
 
+// Free a loaded track which is not played.
+// librespot keeps the chunks of its audio files in memory, which is freed with the file,
+// but readers holding other resources are closed.
+func releaseAudioFile(audioFile io.Reader) {
+	if closer, ok := audioFile.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 func (_ *SpotifyBackend) OnSongFinished(*Song) {}
 
-func (spotify *SpotifyBackend) Play(song *Song, player Player) {
+func (spotify *SpotifyBackend) Play(song *Song, player Player) error {
+	audioFile, ok := spotify.prefetched.Take(song)
+	if !ok {
+		var err error
+		if audioFile, err = spotify.loadTrack(song); err != nil {
+			return err
+		}
+	}
+
+	player.PlayData(audioFile)
+	return nil
+}
+
+// Load the track while the current song plays
+func (spotify *SpotifyBackend) Prefetch(song *Song) {
+	spotify.prefetched.Start(song, func(context.Context) (io.Reader, error) {
+		return spotify.loadTrack(song)
+	})
+}
+
+func (spotify *SpotifyBackend) Discard(song *Song) {
+	spotify.prefetched.Discard(song)
+}
+
+func (spotify *SpotifyBackend) Duration(song *Song) (float64, error) {
+	track, err := spotify.session.Mercury().GetTrack(utils.Base62ToHex(song.Uri))
+	if err != nil {
+		return 0, err
+	}
+	return float64(track.GetDuration()) / 1000, nil
+}
+
+func (spotify *SpotifyBackend) loadTrack(song *Song) (io.Reader, error) {
 	trackID := song.Uri
 	session := spotify.session
 	llog.Debug("Loading track for play: %v", trackID)
@@ -81,8 +127,7 @@ func (spotify *SpotifyBackend) Play(song *Song, player Player) {
 	// Get the track metadata: it holds information about which files and encodings are available
 	track, err := session.Mercury().GetTrack(utils.Base62ToHex(trackID))
 	if err != nil {
-		llog.Error("Error loading track: %s", err)
-		return
+		return nil, fmt.Errorf("loading the metadata of track %s failed: %w", trackID, err)
 	}
 
 	// For now, select the OGG 160kbps variant of the track. The "high quality"
@@ -96,13 +141,17 @@ func (spotify *SpotifyBackend) Play(song *Song, player Player) {
 		}
 	}
 
+	if selectedFile == nil {
+		return nil, fmt.Errorf("track %s is not available as OGG Vorbis 160", trackID)
+	}
+
 	// Synchronously load the track
 	audioFile, err := session.Player().LoadTrack(selectedFile, track.GetGid())
 	if err != nil {
-		llog.Fatal("Error while loading track: %s\n", err)
+		return nil, fmt.Errorf("loading track %s failed: %w", trackID, err)
 	}
 
-	player.PlayData(audioFile)
+	return audioFile, nil
 }
 
 func (spotify *SpotifyBackend) Search(patterns map[string]string) []*Song {
@@ -182,6 +231,7 @@ func (spotify *SpotifyBackend) Search(patterns map[string]string) []*Song {
 			if _, ok := resultMap[uri]; !ok {
 				s := NewSong(track.Name, track.Artists[0].Name, "spotify", uri)
 				s.Album = track.Album.Name
+				s.Duration = float64(track.Duration) / 1000
 				resultMap[uri] = struct{}{}
 				results = append(results, s)
 			}
@@ -240,6 +290,12 @@ func (spotify *SpotifyBackend) loadPlaylist(playlist string) []*Song {
 
 		s := NewSong(*track.Name, *track.Artist[0].Name, "spotify", uri)
 		s.Album = *track.Album.Name
+		s.Duration = float64(track.GetDuration()) / 1000
+		for _, id := range track.GetExternalId() {
+			if id.GetTyp() == "isrc" {
+				s.Isrc = id.GetId()
+			}
+		}
 		songs = append(songs, s)
 	}
 
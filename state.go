@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+
+	"muhq.space/go/wrms/llog"
+
+	"github.com/google/uuid"
+)
+
+// Songs are stored including their server-side only fields
+type storedSong struct {
+	*Song
+	AddedBy uuid.UUID `json:"added-by"`
+}
+
+func newStoredSong(song *Song) *storedSong {
+	if song == nil {
+		return nil
+	}
+	return &storedSong{Song: song, AddedBy: song.AddedBy}
+}
+
+func (s *storedSong) restore() *Song {
+	s.Song.AddedBy = s.AddedBy
+	initVotes(s.Song)
+	return s.Song
+}
+
+// The persistent part of Wrms written to Config.StateFile
+type wrmsState struct {
+	Songs       []*storedSong   `json:"songs"`
+	CurrentSong *storedSong     `json:"current-song"`
+	Playing     bool            `json:"playing"`
+	History     []*HistoryEntry `json:"history"`
+}
+
+// Snapshot the current state to the state file.
+// The rwlock must be held when calling saveState.
+func (wrms *Wrms) saveState() {
+	if wrms.Config.StateFile == "" {
+		return
+	}
+
+	state := wrmsState{
+		CurrentSong: newStoredSong(wrms.CurrentSong.Load()),
+		Playing:     wrms.playing,
+		History:     wrms.History,
+	}
+
+	// Store the songs in their playing order to restore the exact same queue
+	for _, song := range wrms.queue.OrderedList() {
+		state.Songs = append(state.Songs, newStoredSong(song))
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		llog.Error("Encoding the state failed: %v", err)
+		return
+	}
+
+	// Write the state to a temporary file first and rename it afterwards
+	// to never leave a partially written state behind.
+	tmp, err := os.CreateTemp(path.Dir(wrms.Config.StateFile), ".wrms-state-*")
+	if err != nil {
+		llog.Error("Creating temporary state file failed: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		llog.Error("Writing state to %s failed: %v", tmp.Name(), err)
+		return
+	}
+
+	if err = tmp.Close(); err != nil {
+		llog.Error("Closing state file %s failed: %v", tmp.Name(), err)
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), wrms.Config.StateFile); err != nil {
+		llog.Error("Replacing state file %s failed: %v", wrms.Config.StateFile, err)
+	}
+}
+
+// Restore the state from the state file.
+// Returns true if a previous state was restored.
+func (wrms *Wrms) restoreState() bool {
+	if wrms.Config.StateFile == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(wrms.Config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			llog.Error("Reading state file %s failed: %v", wrms.Config.StateFile, err)
+		}
+		return false
+	}
+
+	var state wrmsState
+	if err = json.Unmarshal(data, &state); err != nil {
+		llog.Error("Failed to parse state file %s: %v", wrms.Config.StateFile, err)
+		return false
+	}
+
+	wrms.rwlock.Lock()
+	wrms.History = state.History
+
+	for _, song := range state.Songs {
+		wrms._addSong(song.restore())
+	}
+	llog.Info("Restored %d songs from state file %s", len(state.Songs), wrms.Config.StateFile)
+
+	if state.CurrentSong != nil {
+		currentSong := state.CurrentSong.restore()
+		wrms.CurrentSong.Store(currentSong)
+
+		// Resume the playback interrupted by the restart
+		if state.Playing {
+			wrms.playing = true
+			if err := wrms._play(currentSong); err != nil {
+				wrms._playFailed(currentSong, err)
+				// _next() releases the rwlock
+				wrms._next()
+				return true
+			}
+		}
+	}
+	wrms.unlock()
+	return true
+}
+
+// Songs without any votes may be stored with null vote maps
+func initVotes(song *Song) {
+	if song.Upvotes == nil {
+		song.Upvotes = map[uuid.UUID]struct{}{}
+	}
+
+	if song.Downvotes == nil {
+		song.Downvotes = map[uuid.UUID]struct{}{}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,11 +15,12 @@ import (
 )
 
 type UploadBackend struct {
+	wrms      *Wrms
 	uploadDir string
 }
 
-func NewUploadBackend(uploadDir string) (*UploadBackend, error) {
-	b := UploadBackend{uploadDir: uploadDir}
+func NewUploadBackend(wrms *Wrms, uploadDir string) (*UploadBackend, error) {
+	b := UploadBackend{wrms: wrms, uploadDir: uploadDir}
 
 	dirInfo, err := os.Stat(uploadDir)
 
@@ -36,30 +38,22 @@ func NewUploadBackend(uploadDir string) (*UploadBackend, error) {
 }
 
 func (b *UploadBackend) upload(w http.ResponseWriter, r *http.Request) {
-	data, err := io.ReadAll(r.Body)
+	connId, err := getConnId(w, r)
 	if err != nil {
-		llog.Warning("Failed to read request body: %s", string(data))
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 
-	fileName := r.URL.Query().Get("song")
-
-	filePath := path.Join(b.uploadDir, fileName)
-	f, err := os.Create(filePath)
-	if err != nil {
-		llog.Fatal("Failed to create uploaded %s song on disk: %s", filePath, err)
-	}
-
-	_, err = f.Write(data)
+	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		llog.Fatal("Failed to write uploaded song on disk: %s", err)
+		llog.Warning("Failed to read request body: %s", string(data))
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
 	}
 
-	f.Close()
+	fileName := path.Base(r.URL.Query().Get("song"))
 
-	var title string
-	var artist string
+	var title, artist, album string
+	var year int
 
 	dataReader := bytes.NewReader(data)
 	m, err := tag.ReadFrom(dataReader)
@@ -69,6 +63,8 @@ func (b *UploadBackend) upload(w http.ResponseWriter, r *http.Request) {
 	} else {
 		title = m.Title()
 		artist = m.Artist()
+		album = m.Album()
+		year = m.Year()
 	}
 
 	if title == "" {
@@ -79,12 +75,55 @@ func (b *UploadBackend) upload(w http.ResponseWriter, r *http.Request) {
 		artist = "Unknown"
 	}
 
-	wrms.AddSong(NewDetailedSong(title, artist, "upload", fileName, m.Album(), m.Year()))
+	song := NewDetailedSong(title, artist, "upload", fileName, album, year)
+	song.AddedBy = connId
+	song.Nickname = r.URL.Query().Get("nickname")
+
+	// Do not store songs exceeding the submitter's quota
+	if err := b.wrms.checkLimits(song); err != nil {
+		b.wrms.notifyRejected(song, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	// Store each upload in its own file to not replace the file of a queued song
+	f, err := os.CreateTemp(b.uploadDir, "*-"+fileName)
+	if err != nil {
+		llog.Fatal("Failed to create uploaded %s song on disk: %s", fileName, err)
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		llog.Fatal("Failed to write uploaded song on disk: %s", err)
+	}
+
+	f.Close()
+
+	filePath := f.Name()
+	song.Uri = path.Base(filePath)
+	song.Duration = probeDuration(filePath)
+
+	err = b.wrms.AddSong(song)
+	// Rejected and merged uploads are not played
+	if !b.wrms.IsQueued(song) {
+		os.Remove(filePath)
+	}
+
+	if err != nil {
+		b.wrms.notifyRejected(song, err)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrQuotaExceeded) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	fmt.Fprintf(w, "Added uploaded song %s", string(fileName))
 }
 
 func (b *UploadBackend) setupUploadRoute() {
-	http.HandleFunc("/upload", b.upload)
+	b.wrms.mux.HandleFunc("/upload", b.upload)
 }
 
 func (b *UploadBackend) OnSongFinished(song *Song) {
@@ -93,8 +132,18 @@ func (b *UploadBackend) OnSongFinished(song *Song) {
 	os.Remove(songPath)
 }
 
-func (b *UploadBackend) Play(song *Song, player Player) {
-	player.PlayUri("file://" + path.Join(b.uploadDir, song.Uri))
+func (b *UploadBackend) Play(song *Song, player Player) error {
+	p := path.Join(b.uploadDir, song.Uri)
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
+
+	player.PlayUri("file://" + p)
+	return nil
+}
+
+func (b *UploadBackend) Duration(song *Song) (float64, error) {
+	return probeDuration(path.Join(b.uploadDir, song.Uri)), nil
 }
 
 func (b *UploadBackend) Search(map[string]string) []*Song {
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"muhq.space/go/wrms/llog"
 
@@ -10,9 +14,17 @@ import (
 )
 
 type Event struct {
-	Event string  `json:"cmd"`
-	Id    uint64  `json:"id"`
-	Songs []*Song `json:"songs"`
+	Event     string          `json:"cmd"`
+	Id        uint64          `json:"id"`
+	Songs     []*Song         `json:"songs"`
+	History   []*HistoryEntry `json:"history,omitempty"`
+	SkipVotes *SkipVotes      `json:"skipvotes,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Order     []string        `json:"order,omitempty"` // ids of the queued songs
+	Progress  *Progress       `json:"progress,omitempty"`
+	StartedAt *time.Time      `json:"startedAt,omitempty"`
+	Volume    *int            `json:"volume,omitempty"`
+	Filter    string          `json:"filter,omitempty"` // name of the audio filter preset
 }
 
 func (wrms *Wrms) incEventId() uint64 {
@@ -37,6 +49,8 @@ func (wrms *Wrms) newNotification(notification string) Event {
 }
 
 type Wrms struct {
+	Name        string
+	mux         *http.ServeMux
 	Connections sync.Map
 	nextConnNr  atomic.Uint64
 	// The rwlock must be held when using most internal state
@@ -48,12 +62,95 @@ type Wrms struct {
 	playing     bool
 	Config      Config
 	eventId     atomic.Uint64
+	History     []*HistoryEntry
+	skipVotes   map[uuid.UUID]struct{}
+	// Autofill candidates related to the current song
+	relatedSongs []*Song
+	fallback     *FallbackPlaylist
+	// Times of the recent adds of each connection
+	recentAdds map[uuid.UUID][]time.Time
+	// The history entry of the currently playing song
+	playEntry *HistoryEntry
+	// The clients were told an order not following the song scores
+	orderAnnounced bool
+	// When the current song would have started if it was never paused
+	startedAt time.Time
+	pausedAt  time.Time
+	// Duration of the current song reported by the player
+	reportedDuration float64
+	volume           int
+	// The active audio filter preset
+	audioFilter string
+	// The song at the top of the queue prefetched by its backend
+	prefetched *Song
+	// Backends which failed to play songs
+	backendHealth map[string]*backendHealth
+	// Songs which failed to play since the last successfully played song
+	failedPlays int
+	// Events collected while holding the rwlock and sent by unlock
+	pending []pendingEvent
 }
 
-func NewWrms(config Config) *Wrms {
-	wrms := Wrms{}
+type pendingEvent struct {
+	ev         Event
+	adminsOnly bool
+}
+
+func NewWrms(name string, config Config, newPlayer func(wrms *Wrms) Player) *Wrms {
+	wrms := Wrms{Name: name}
 	wrms.Config = config
-	wrms.Player = NewMpvPlayer(&wrms, config.Backends)
+	wrms.Config.Bans.compile()
+	// The routes must be available before the backends register their own routes
+	wrms.mux = http.NewServeMux()
+	wrms.setupRoutes()
+	wrms.Player = newPlayer(&wrms)
+
+	wrms.volume = config.Volume
+	if err := wrms.Player.SetVolume(config.Volume); err != nil {
+		llog.Error("Setting the initial volume failed: %v", err)
+	}
+
+	ranking, err := NewRankingStrategy(config.Ranking)
+	if err != nil {
+		llog.Error("%v: falling back to the %s ranking", err, DEFAULT_RANKING)
+		ranking, _ = NewRankingStrategy(DEFAULT_RANKING)
+		// Clients are told the ranking actually used
+		wrms.Config.Ranking = DEFAULT_RANKING
+	}
+	switch config.QueueMode {
+	case QUEUE_MODE_FAIR:
+		wrms.queue = NewFairPlaylist(ranking)
+	case QUEUE_MODE_VOTE, "":
+		wrms.queue = NewPlaylist(ranking)
+	default:
+		llog.Error("Unknown queue mode %s: falling back to %s", config.QueueMode, QUEUE_MODE_VOTE)
+		wrms.queue = NewPlaylist(ranking)
+	}
+
+	if config.ProgressInterval > 0 {
+		go wrms.broadcastProgressPeriodically(time.Duration(config.ProgressInterval) * time.Second)
+	}
+
+	switch config.TimeBonusMode {
+	case TIME_BONUS_CONTINUOUS:
+		if config.TimeBonus != 0 {
+			go wrms.applyTimeBonusPeriodically(time.Duration(config.TimeBonusInterval) * time.Second)
+		}
+	case TIME_BONUS_ON_ADD, "":
+	default:
+		llog.Error("Unknown time bonus mode %s: falling back to %s",
+			config.TimeBonusMode, TIME_BONUS_ON_ADD)
+		wrms.Config.TimeBonusMode = TIME_BONUS_ON_ADD
+	}
+
+	if config.Fallback != nil {
+		wrms.fallback = wrms.loadFallback(*config.Fallback)
+	}
+
+	// The playlists are already part of a restored queue
+	if wrms.restoreState() {
+		return &wrms
+	}
 
 	if len(wrms.Config.Playlists) > 0 {
 		wrms.loadPlaylists(wrms.Config.Playlists)
@@ -85,8 +182,26 @@ func (wrms *Wrms) initConn(conn *Connection) {
 
 	initialCmds := []interface{}{}
 
+	ranking := wrms.Config.Ranking
+	if ranking == "" {
+		ranking = DEFAULT_RANKING
+	}
+	initialCmds = append(initialCmds, map[string]any{"cmd": "ranking", "ranking": ranking})
+
 	if wrms.Config.TimeBonus != 0 {
-		ev := map[string]any{"cmd": "timeBonus", "timeBonus": wrms.Config.TimeBonus}
+		ev := map[string]any{"cmd": "timeBonus", "timeBonus": wrms.Config.TimeBonus,
+			"mode": wrms.timeBonusMode()}
+		initialCmds = append(initialCmds, ev)
+	}
+
+	volume := wrms.volume
+	volumeEv := wrms.newPrivateEvent(curEventId, "volume", nil)
+	volumeEv.Volume = &volume
+	initialCmds = append(initialCmds, volumeEv)
+
+	if wrms.Config.IsAdmin(conn.Id) && len(wrms.Config.AudioFilters) > 0 {
+		ev := map[string]any{"cmd": "audioFilters", "presets": wrms.audioFilterPresets(),
+			"filter": wrms.audioFilter}
 		initialCmds = append(initialCmds, ev)
 	}
 
@@ -95,15 +210,28 @@ func (wrms *Wrms) initConn(conn *Connection) {
 		if currentSong := wrms.CurrentSong.Load(); currentSong != nil {
 			songs = []*Song{currentSong}
 		}
-		initialCmds = append(initialCmds, wrms.newPrivateEvent(curEventId, "play", songs))
+		ev := wrms.newPrivateEvent(curEventId, "play", songs)
+		wrms._addProgress(&ev)
+		initialCmds = append(initialCmds, ev)
+	} else if currentSong := wrms.CurrentSong.Load(); currentSong != nil {
+		ev := wrms.newPrivateEvent(curEventId, "next", []*Song{currentSong})
+		wrms._addProgress(&ev)
+		initialCmds = append(initialCmds, ev)
 	}
 
 	upvoted := []*Song{}
 	downvoted := []*Song{}
 	if len(wrms.Songs) > 0 {
-		initialCmds = append(initialCmds, wrms.newPrivateEvent(curEventId, "add", wrms.Songs))
+		// Send the songs in play order because clients keep the order of equally ranked songs
+		queued := wrms.queue.OrderedList()
+		initialCmds = append(initialCmds, wrms.newPrivateEvent(curEventId, "add", queued))
+		if order := wrms._queueOrder(); order != nil {
+			ev := wrms.newPrivateEvent(curEventId, "reorder", nil)
+			ev.Order = order
+			initialCmds = append(initialCmds, ev)
+		}
 
-		for _, song := range wrms.queue.OrderedList() {
+		for _, song := range queued {
 			llog.DDebug("Looking at the votes of song: %v", song)
 			if _, ok := song.Upvotes[conn.Id]; ok {
 				upvoted = append(upvoted, song)
@@ -121,16 +249,47 @@ func (wrms *Wrms) initConn(conn *Connection) {
 		initialCmds = append(initialCmds, wrms.newPrivateEvent(curEventId, "downvoted", downvoted))
 	}
 
+	if owned := wrms._songsAddedBy(conn.Id); len(owned) > 0 {
+		initialCmds = append(initialCmds, wrms.newPrivateEvent(curEventId, "owned", owned))
+	}
+
+	if wrms.Config.SkipThreshold > 0 {
+		ev := wrms.newPrivateEvent(curEventId, "skipvotes", nil)
+		ev.SkipVotes = wrms._skipVotes()
+		initialCmds = append(initialCmds, ev)
+	}
+
+	if len(wrms.History) > 0 {
+		ev := wrms.newPrivateEvent(curEventId, "history", nil)
+		ev.History = wrms._historyPage(0, RECENT_HISTORY_SIZE)
+		initialCmds = append(initialCmds, ev)
+	}
+
 	wrms.rwlock.RUnlock()
 	llog.Info("Sending initial cmds %v", initialCmds)
 	conn._send(initialCmds)
 }
 
 func (wrms *Wrms) GetConn(connId uuid.UUID) *Connection {
-	conn, _ := wrms.Connections.Load(connId)
+	// Clients may use a room without being connected to its events
+	conn, ok := wrms.Connections.Load(connId)
+	if !ok {
+		return nil
+	}
 	return conn.(*Connection)
 }
 
+// Send an event only to the connections of the admins
+func (wrms *Wrms) notifyAdmins(ev Event) {
+	llog.Info("Notifying the admins about %v", ev)
+	wrms.Connections.Range(func(_, conn any) bool {
+		if c := conn.(*Connection); wrms.Config.IsAdmin(c.Id) {
+			c.Send(ev)
+		}
+		return true
+	})
+}
+
 func (wrms *Wrms) Broadcast(ev Event) {
 	llog.Info("Broadcasting %v", ev)
 	wrms.Connections.Range(func(_, conn any) bool {
@@ -139,104 +298,545 @@ func (wrms *Wrms) Broadcast(ev Event) {
 	})
 }
 
+// Broadcast the event once the rwlock is released by unlock.
+// Sending must not happen while holding the rwlock because it blocks until the
+// connection is served, which needs the rwlock to initialize new connections.
+// The rwlock must be held when calling _broadcast.
+func (wrms *Wrms) _broadcast(ev Event) {
+	wrms.pending = append(wrms.pending, pendingEvent{ev: ev})
+}
+
+// The rwlock must be held when calling _notifyAdmins.
+func (wrms *Wrms) _notifyAdmins(ev Event) {
+	wrms.pending = append(wrms.pending, pendingEvent{ev: ev, adminsOnly: true})
+}
+
+// Release the rwlock and send the events collected while holding it
+func (wrms *Wrms) unlock() {
+	pending := wrms.pending
+	wrms.pending = nil
+	wrms.rwlock.Unlock()
+
+	for _, p := range pending {
+		if p.adminsOnly {
+			wrms.notifyAdmins(p.ev)
+		} else {
+			wrms.Broadcast(p.ev)
+		}
+	}
+}
+
+// Return the ids of the queued songs in the order they will be played or
+// nil if they are played in the order of their scores.
+// The rwlock must be held when calling _queueOrder.
+func (wrms *Wrms) _queueOrder() []string {
+	if wrms.queue.scoreOrdered() {
+		return nil
+	}
+
+	order := []string{}
+	for _, s := range wrms.queue.OrderedList() {
+		order = append(order, s.Id)
+	}
+	return order
+}
+
+// The rwlock must be held when calling _newReorderEvent.
+func (wrms *Wrms) _newReorderEvent(songs []*Song) Event {
+	ev := wrms.newEvent("reorder", songs)
+	ev.Order = wrms._queueOrder()
+	wrms.orderAnnounced = ev.Order != nil
+	return ev
+}
+
+// Announce the queue order if it does not follow the song scores
+// or did not follow them in the last announcement.
+// The rwlock must be held when calling _broadcastOrder.
+func (wrms *Wrms) _broadcastOrder() {
+	if wrms.queue.scoreOrdered() && !wrms.orderAnnounced {
+		return
+	}
+
+	wrms._broadcast(wrms._newReorderEvent(nil))
+}
+
 func (wrms *Wrms) _addSong(song *Song) {
+	if song.Id == "" {
+		song.Id = uuid.NewString()
+	}
+	if song.Added.IsZero() {
+		song.Added = time.Now()
+	}
 	wrms.Songs = append(wrms.Songs, song)
 	wrms.queue.Add(song)
 }
 
-func (wrms *Wrms) AddSong(song *Song) {
+var (
+	ErrDuplicate       = errors.New("song already queued")
+	ErrRecentlyPlayed  = errors.New("song played recently")
+	ErrTooLong         = errors.New("song too long")
+	ErrUnknownDuration = errors.New("song duration unknown")
+)
+
+// Reject songs longer than Config.MaxDuration seconds.
+// Songs with an unknown duration are rejected if a limit is set.
+func (wrms *Wrms) checkDuration(song *Song) error {
+	max := wrms.Config.MaxDuration
+	if max <= 0 {
+		return nil
+	}
+
+	// Songs of unknown duration would bypass the limit
+	if song.Duration <= 0 {
+		return fmt.Errorf("%w: the duration of %s is unknown", ErrUnknownDuration, song.Title)
+	}
+
+	if song.Duration <= float64(max) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s is longer than %v", ErrTooLong, song.Title,
+		time.Duration(max)*time.Second)
+}
+
+// Reject songs played during the last Config.ReplayWindow seconds.
+// The rwlock must be held when calling _checkRecentlyPlayed.
+func (wrms *Wrms) _checkRecentlyPlayed(song *Song) error {
+	window := time.Duration(wrms.Config.ReplayWindow) * time.Second
+	if window <= 0 {
+		return nil
+	}
+
+	if cur := wrms.CurrentSong.Load(); cur != nil && cur.Key() == song.Key() {
+		return fmt.Errorf("%w: %s is playing right now", ErrRecentlyPlayed, song.Title)
+	}
+
+	// The history is ordered by the end of the songs
+	for i := len(wrms.History) - 1; i >= 0; i-- {
+		entry := wrms.History[i]
+		ago := time.Since(entry.Ended)
+		if ago > window {
+			break
+		}
+
+		if entry.Song.Key() == song.Key() {
+			return fmt.Errorf("%w: %s was played %v ago", ErrRecentlyPlayed,
+				song.Title, ago.Round(time.Minute))
+		}
+	}
+
+	return nil
+}
+
+// Merge the add of an already queued song into an upvote of its submitter.
+// The rwlock must be held when calling _mergeDuplicate and is released.
+func (wrms *Wrms) _mergeDuplicate(dup, song *Song) error {
+	if song.AddedBy == uuid.Nil {
+		wrms.rwlock.Unlock()
+		return ErrDuplicate
+	}
+
+	if err := wrms._vote(dup, song.AddedBy, "up"); err != nil {
+		wrms.rwlock.Unlock()
+		return fmt.Errorf("%w: %s is already queued and upvoted", ErrDuplicate, song.Title)
+	}
+
+	llog.Info("Merged add of %v into an upvote of %v", song, dup)
+	wrms.saveState()
+	ev := wrms.newEvent("update", []*Song{dup})
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
+
+	wrms.Broadcast(ev)
+	if conn := wrms.GetConn(song.AddedBy); conn != nil {
+		conn.SendPrivate("upvoted", []*Song{dup})
+	}
+	return nil
+}
+
+func (wrms *Wrms) AddSong(song *Song) error {
+	if err := wrms.checkDuration(song); err != nil {
+		llog.Info("Rejected song %v: %v", song, err)
+		return err
+	}
+
 	wrms.rwlock.Lock()
 
+	if err := wrms._checkBanned(song); err != nil {
+		wrms.rwlock.Unlock()
+		llog.Info("Rejected song %v: %v", song, err)
+		return err
+	}
+
+	if err := wrms._checkRecentlyPlayed(song); err != nil {
+		wrms.rwlock.Unlock()
+		llog.Info("Rejected song %v: %v", song, err)
+		return err
+	}
+
+	if dup := wrms._findDuplicate(song); dup != nil && !wrms.Config.AllowDuplicates {
+		// _mergeDuplicate() releases the rwlock
+		return wrms._mergeDuplicate(dup, song)
+	}
+
+	var sameTrack *Song
+	if wrms.Config.CrossSourceDuplicates != CROSS_SOURCE_IGNORE {
+		sameTrack = wrms._findSameTrack(song)
+	}
+
+	if sameTrack != nil && wrms.Config.CrossSourceDuplicates == CROSS_SOURCE_MERGE {
+		// _mergeDuplicate() releases the rwlock
+		return wrms._mergeDuplicate(sameTrack, song)
+	}
+
+	if err := wrms._checkLimits(song); err != nil {
+		wrms.rwlock.Unlock()
+		llog.Info("Rejected song %v: %v", song, err)
+		return err
+	}
+	wrms._recordAdd(song)
+
 	startPlayingAgain := wrms.playing && wrms.CurrentSong.Load() == nil
 
-	if wrms.Config.TimeBonus != 0 {
+	if wrms.Config.TimeBonus != 0 && wrms.timeBonusMode() == TIME_BONUS_ON_ADD {
 		llog.Info("Apply time bonus %v", wrms.Config.TimeBonus)
 		wrms.queue.applyTimeBonus(wrms.Config.TimeBonus)
 	}
 
 	wrms._addSong(song)
+	wrms.saveState()
 
 	ev := wrms.newEvent("add", []*Song{song})
-	wrms.rwlock.Unlock()
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
 
-	llog.Info("Added song %s (ptr=%p) to Songs", song.Uri, song)
+	llog.Info("Added song %s as %s (ptr=%p) to Songs", song.Key(), song.Id, song)
 	wrms.Broadcast(ev)
+	wrms.notifySubmitter(song)
+	if sameTrack != nil {
+		wrms.notifyDuplicate(song, sameTrack)
+	}
 
 	if startPlayingAgain {
 		wrms._lockedNext()
 	}
+
+	return nil
 }
 
-func (wrms *Wrms) DeleteSong(songUri string) {
-	wrms.rwlock.Lock()
+const (
+	TIME_BONUS_ON_ADD     = "add"
+	TIME_BONUS_CONTINUOUS = "continuous"
+)
+
+const DEFAULT_TIME_BONUS_INTERVAL = 10 * time.Second
+
+func (wrms *Wrms) timeBonusMode() string {
+	if wrms.Config.TimeBonusMode == "" {
+		return TIME_BONUS_ON_ADD
+	}
+	return wrms.Config.TimeBonusMode
+}
+
+// Let the weight of the queued songs grow with their waiting time
+func (wrms *Wrms) applyTimeBonusPeriodically(interval time.Duration) {
+	if interval <= 0 {
+		llog.Error("Invalid time bonus interval %v: using %v", interval, DEFAULT_TIME_BONUS_INTERVAL)
+		interval = DEFAULT_TIME_BONUS_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	last := time.Now()
 
-	for i := 0; i < len(wrms.Songs); i++ {
-		s := wrms.Songs[i]
-		if s.Uri != songUri {
+	for now := range ticker.C {
+		wrms.rwlock.Lock()
+		if wrms.queue.Len() == 0 {
+			last = now
+			wrms.rwlock.Unlock()
 			continue
 		}
 
-		wrms.Songs[i] = wrms.Songs[len(wrms.Songs)-1]
-		wrms.Songs = wrms.Songs[:len(wrms.Songs)-1]
+		wrms.queue.applyWaitBonus(wrms.Config.TimeBonus, last, now)
+		last = now
+		wrms.saveState()
 
-		wrms.queue.RemoveSong(s)
-
-		ev := wrms.newEvent("delete", []*Song{s})
-		wrms.rwlock.Unlock()
+		ev := wrms.newEvent("update", wrms.queue.OrderedList())
+		wrms._broadcastOrder()
+		wrms._prefetchNext()
+		wrms.unlock()
 
 		wrms.Broadcast(ev)
-		break
 	}
 }
 
+// The rwlock must be held when calling _songsAddedBy.
+func (wrms *Wrms) _songsAddedBy(connId uuid.UUID) []*Song {
+	songs := []*Song{}
+	for _, s := range wrms.Songs {
+		if s.AddedBy == connId {
+			songs = append(songs, s)
+		}
+	}
+	return songs
+}
+
+// Let the submitter know that it added the song
+func (wrms *Wrms) notifySubmitter(song *Song) {
+	if conn := wrms.GetConn(song.AddedBy); conn != nil {
+		conn.SendPrivate("owned", []*Song{song})
+	}
+}
+
+// Report if the queued song was added by the connection
+func (wrms *Wrms) IsSubmitter(connId uuid.UUID, songId string) bool {
+	wrms.rwlock.RLock()
+	defer wrms.rwlock.RUnlock()
+
+	if i := wrms._songIndex(songId); i >= 0 {
+		return wrms.Songs[i].AddedBy == connId
+	}
+	return false
+}
+
+// Report if the song is queued or currently playing
+func (wrms *Wrms) IsQueued(song *Song) bool {
+	wrms.rwlock.RLock()
+	defer wrms.rwlock.RUnlock()
+
+	if cur := wrms.CurrentSong.Load(); cur != nil && cur.Key() == song.Key() {
+		return true
+	}
+	return wrms._findDuplicate(song) != nil
+}
+
+// Return the index of the queue entry or -1 if it is not queued.
+// The rwlock must be held when calling _songIndex.
+func (wrms *Wrms) _songIndex(songId string) int {
+	for i, s := range wrms.Songs {
+		if s.Id == songId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the queued song with the same source and uri or nil.
+// The rwlock must be held when calling _findDuplicate.
+func (wrms *Wrms) _findDuplicate(song *Song) *Song {
+	for _, s := range wrms.Songs {
+		if s.Key() == song.Key() {
+			return s
+		}
+	}
+	return nil
+}
+
+func (wrms *Wrms) DeleteSong(songId string) {
+	wrms.rwlock.Lock()
+
+	i := wrms._songIndex(songId)
+	if i < 0 {
+		wrms.rwlock.Unlock()
+		llog.Warning("Deleting not queued song %s", songId)
+		return
+	}
+
+	s := wrms.Songs[i]
+	wrms.Songs[i] = wrms.Songs[len(wrms.Songs)-1]
+	wrms.Songs = wrms.Songs[:len(wrms.Songs)-1]
+
+	wrms.queue.RemoveSong(s)
+	wrms.saveState()
+
+	ev := wrms.newEvent("delete", []*Song{s})
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
+
+	wrms.Broadcast(ev)
+}
+
 func (wrms *Wrms) Next() {
 	wrms.rwlock.Lock()
+	wrms._skip()
+}
 
+func (wrms *Wrms) _skip() {
 	// Terminate the Player if it is currently playing
 	if wrms.Player.Playing() {
 		wrms.Player.Stop()
 	}
 
+	wrms._endPlay(true)
 	wrms._next()
 }
 
 func (wrms *Wrms) _lockedNext() {
 	wrms.rwlock.Lock()
+	wrms._endPlay(false)
 	wrms._next()
 }
 
-func (wrms *Wrms) _next() {
-	llog.DDebug("Next Song")
+// Continue with the next song after the player finished playing song.
+// Nothing happens if song is no longer the current song because it was skipped meanwhile.
+func (wrms *Wrms) SongFinished(song *Song) {
+	wrms.rwlock.Lock()
+	if wrms.CurrentSong.Load() != song {
+		llog.Debug("Ignoring the end of %v which is no longer the current song", song)
+		wrms.rwlock.Unlock()
+		return
+	}
 
-	next := wrms.queue.PopSong()
-	if next == nil {
-		wrms.CurrentSong.Store(nil)
-		wrms.Broadcast(wrms.newNotification("stop"))
+	wrms._endPlay(false)
+	wrms._next()
+}
+
+// Skip a song the player failed to play and tell the clients about it.
+// Nothing happens if song is no longer the current song.
+func (wrms *Wrms) SongFailed(song *Song, reason error) {
+	wrms.rwlock.Lock()
+	if wrms.CurrentSong.Load() != song {
+		llog.Debug("Ignoring the failure of %v which is no longer the current song", song)
 		wrms.rwlock.Unlock()
 		return
 	}
 
-	wrms.CurrentSong.Store(next)
+	llog.Error("Playing %v failed: %v", song, reason)
+	ev := wrms.newEvent("error", []*Song{song})
+	ev.Reason = reason.Error()
+	wrms._broadcast(ev)
 
-	llog.Info("popped next song and removing it from the song list %v", next)
+	wrms._endPlay(true)
+	wrms._next()
+}
 
-	for i, s := range wrms.Songs {
-		if s.Uri == next.Uri {
-			wrms.Songs[i] = wrms.Songs[len(wrms.Songs)-1]
-			wrms.Songs = wrms.Songs[:len(wrms.Songs)-1]
-			break
+// Warn the admins that the player is unable to play any song
+func (wrms *Wrms) PlayerFailing(reason error) {
+	wrms.notifyAdmins(wrms.newPlayerErrorEvent(reason))
+}
+
+func (wrms *Wrms) newPlayerErrorEvent(reason error) Event {
+	ev := wrms.newPrivateEvent(0, "playererror", nil)
+	ev.Reason = reason.Error()
+	return ev
+}
+
+// Let the player prepare the song at the top of the queue to follow song without a gap.
+// The prepared song is only played if it is still at the top when song ends.
+func (wrms *Wrms) PrepareNext(song *Song) {
+	wrms.rwlock.Lock()
+	defer wrms.rwlock.Unlock()
+
+	if wrms.CurrentSong.Load() != song || !wrms.playing {
+		return
+	}
+
+	if next := wrms.queue.PeekFunc(wrms._playable); next != nil {
+		wrms.Player.Prepare(next)
+	}
+}
+
+// Let the backend of the song at the top of the queue prepare playing it while
+// the current song plays and discard a prefetched song no longer at the top.
+// The rwlock must be held when calling _prefetchNext.
+func (wrms *Wrms) _prefetchNext() {
+	current := wrms.CurrentSong.Load()
+	var next *Song
+	if current != nil {
+		next = wrms.queue.PeekFunc(wrms._playable)
+	}
+
+	if next == wrms.prefetched {
+		return
+	}
+
+	// A prefetched song which became the current song is needed to play it
+	if wrms.prefetched != nil && wrms.prefetched != current {
+		wrms.Player.Discard(wrms.prefetched)
+	}
+
+	wrms.prefetched = next
+	if next != nil {
+		wrms.Player.Prefetch(next)
+	}
+}
+
+func (wrms *Wrms) _next() {
+	llog.DDebug("Next Song")
+
+	// The previous song may have been prefetched but never played
+	if prev := wrms.CurrentSong.Load(); prev != nil {
+		wrms.Player.Discard(prev)
+	}
+
+	// Skip votes only apply to the song they were cast for
+	wrms.skipVotes = nil
+
+	// Songs of unhealthy backends stay queued until their backend recovers
+	next := wrms.queue.PopSongFunc(wrms._playable)
+	if next != nil {
+		llog.Info("popped next song and removing it from the song list %v", next)
+
+		for i, s := range wrms.Songs {
+			if s == next {
+				wrms.Songs[i] = wrms.Songs[len(wrms.Songs)-1]
+				wrms.Songs = wrms.Songs[:len(wrms.Songs)-1]
+				break
+			}
 		}
+	} else if wrms.fallback != nil {
+		// The queue is empty -> play the fallback playlist
+		next = wrms.fallback.Next()
+		// Skip banned songs but stop after a full pass through the playlist
+		for i := 0; next != nil && wrms._checkBanned(next) != nil && i < len(wrms.fallback.songs); i++ {
+			next = wrms.fallback.Next()
+		}
+		if next != nil && wrms._checkBanned(next) != nil {
+			next = nil
+		}
+	}
+
+	// Nothing else to play -> let the autofill pick a song
+	if next == nil {
+		next = wrms._autofill()
+	}
+
+	if next == nil {
+		// Do not let the player continue with a prepared song removed meanwhile
+		if wrms.Player.Playing() {
+			wrms.Player.Stop()
+		}
+
+		wrms.CurrentSong.Store(nil)
+		wrms._prefetchNext()
+		wrms.saveState()
+		wrms._broadcast(wrms.newNotification("stop"))
+		wrms.unlock()
+		return
 	}
 
+	wrms.CurrentSong.Store(next)
+
 	cmd := "next"
 	// We are playing -> start playing the next song
 	if wrms.playing {
-		wrms.Player.Play(next)
+		if err := wrms._play(next); err != nil {
+			wrms._playFailed(next, err)
+			// _next() releases the rwlock
+			wrms._next()
+			return
+		}
 		cmd = "play"
 	}
 
+	wrms.saveState()
 	ev := wrms.newEvent(cmd, []*Song{next})
-	wrms.rwlock.Unlock()
+	wrms._addProgress(&ev)
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
 
 	wrms.Broadcast(ev)
 }
@@ -249,8 +849,12 @@ func (wrms *Wrms) PlayPause() {
 	// Wrms was playing -> pause the player
 	if !wrms.playing {
 		wrms.Player.Pause()
+		wrms._pauseProgress()
+		wrms.saveState()
+		ev := wrms.newNotification("pause")
+		wrms._addProgress(&ev)
 		wrms.rwlock.Unlock()
-		wrms.Broadcast(wrms.newNotification("pause"))
+		wrms.Broadcast(ev)
 		return
 	}
 
@@ -268,84 +872,102 @@ func (wrms *Wrms) PlayPause() {
 	// The player is playing -> continue playing
 	if wrms.Player.Playing() {
 		wrms.Player.Continue()
+		wrms._resumeProgress()
 		// The player is stopped -> start it
-	} else {
-		wrms.Player.Play(currentSong)
+	} else if err := wrms._play(currentSong); err != nil {
+		wrms._playFailed(currentSong, err)
+		// _next() releases the rwlock
+		wrms._next()
+		return
 	}
 
+	wrms.saveState()
 	ev := wrms.newEvent("play", []*Song{currentSong})
-	wrms.rwlock.Unlock()
+	wrms._addProgress(&ev)
+	wrms.unlock()
 
 	wrms.Broadcast(ev)
 }
 
-func (wrms *Wrms) AdjustSongWeight(connId uuid.UUID, songUri string, vote string) {
-	wrms.rwlock.Lock()
+// Apply the vote of a connection to a queued song.
+// The rwlock must be held when calling _vote.
+func (wrms *Wrms) _vote(s *Song, connId uuid.UUID, vote string) error {
+	llog.Info("Adjusting song %v (ptr=%p)", s, s)
+	switch vote {
+	case "up":
+		if _, ok := s.Upvotes[connId]; ok {
+			return fmt.Errorf("Double upvote of song %s by connections %s", s.Id, connId)
+		}
 
-	for i := 0; i < len(wrms.Songs); i++ {
-		s := wrms.Songs[i]
-		if s.Uri != songUri {
-			continue
+		if _, ok := s.Downvotes[connId]; ok {
+			delete(s.Downvotes, connId)
+			s.Weight += 2.0
+			llog.Debug("Flip downvote")
+		} else {
+			s.Weight += 1.0
 		}
 
-		llog.Info("Adjusting song %v (ptr=%p)", s, s)
-		switch vote {
-		case "up":
-			if _, ok := s.Upvotes[connId]; ok {
-				llog.Error("Double upvote of song %s by connections %s", songUri, connId)
-				return
-			}
+		s.Upvotes[connId] = struct{}{}
 
-			if _, ok := s.Downvotes[connId]; ok {
-				delete(s.Downvotes, connId)
-				s.Weight += 2.0
-				llog.Debug("Flip downvote")
-			} else {
-				s.Weight += 1.0
-			}
+	case "down":
+		if _, ok := s.Downvotes[connId]; ok {
+			return fmt.Errorf("Double downvote of song %s by connections %s", s.Id, connId)
+		}
 
-			s.Upvotes[connId] = struct{}{}
+		if _, ok := s.Upvotes[connId]; ok {
+			delete(s.Upvotes, connId)
+			llog.Debug("Flip upvote")
+			s.Weight -= 2.0
+		} else {
+			s.Weight -= 1.0
+		}
 
-		case "down":
-			if _, ok := s.Downvotes[connId]; ok {
-				llog.Error("Double downvote of song %s by connections %s", songUri, connId)
-				return
-			}
+		s.Downvotes[connId] = struct{}{}
 
-			if _, ok := s.Upvotes[connId]; ok {
-				delete(s.Upvotes, connId)
-				llog.Debug("Flip upvote")
-				s.Weight -= 2.0
-			} else {
-				s.Weight -= 1.0
-			}
+	case "unvote":
+		if _, ok := s.Downvotes[connId]; ok {
+			delete(s.Downvotes, connId)
+			s.Weight += 1.0
 
-			s.Downvotes[connId] = struct{}{}
+		} else if _, ok := s.Upvotes[connId]; ok {
+			delete(s.Upvotes, connId)
+			s.Weight -= 1.0
+		} else {
+			return fmt.Errorf("Double unvote of song %s by connections %s", s.Id, connId)
+		}
 
-		case "unvote":
-			if _, ok := s.Downvotes[connId]; ok {
-				delete(s.Downvotes, connId)
-				s.Weight += 1.0
+	default:
+		return fmt.Errorf("invalid vote %s", vote)
+	}
 
-			} else if _, ok := s.Upvotes[connId]; ok {
-				delete(s.Upvotes, connId)
-				s.Weight -= 1.0
-			} else {
-				llog.Error("Double unvote of song %s by connections %s", songUri, connId)
-				return
-			}
+	wrms.queue.Adjust(s)
+	return nil
+}
 
-		default:
-			llog.Fatal("invalid vote")
-		}
+func (wrms *Wrms) AdjustSongWeight(connId uuid.UUID, songId string, vote string) {
+	wrms.rwlock.Lock()
 
-		wrms.queue.Adjust(s)
-		ev := wrms.newEvent("update", []*Song{s})
+	i := wrms._songIndex(songId)
+	if i < 0 {
 		wrms.rwlock.Unlock()
+		llog.Warning("Voting for not queued song %s", songId)
+		return
+	}
 
-		wrms.Broadcast(ev)
-		break
+	s := wrms.Songs[i]
+	if err := wrms._vote(s, connId, vote); err != nil {
+		wrms.rwlock.Unlock()
+		llog.Error("%v", err)
+		return
 	}
+
+	wrms.saveState()
+	ev := wrms.newEvent("update", []*Song{s})
+	wrms._broadcastOrder()
+	wrms._prefetchNext()
+	wrms.unlock()
+
+	wrms.Broadcast(ev)
 }
 
 func (wrms *Wrms) Search(pattern map[string]string) chan []*Song {
@@ -362,6 +984,15 @@ func (wrms *Wrms) appendPlaylist(playlist string) {
 	songs := wrms.Player.LoadPlaylist(playlist)
 
 	for _, song := range songs {
+		if wrms._findDuplicate(song) != nil && !wrms.Config.AllowDuplicates {
+			llog.Debug("Skipping duplicate %v in playlist %s", song, playlist)
+			continue
+		}
+
+		if err := wrms._checkBanned(song); err != nil {
+			llog.Debug("Skipping %v in playlist %s: %v", song, playlist, err)
+			continue
+		}
 		wrms._addSong(song)
 	}
 }
@@ -1,23 +1,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
 )
 
 type mockPlayer struct{}
 
-func (p *mockPlayer) Play(*Song)                                          {}
+func (p *mockPlayer) Play(*Song) error                                    { return nil }
 func (p *mockPlayer) PlayUri(string)                                      {}
 func (p *mockPlayer) PlayData(io.Reader)                                  {}
 func (p *mockPlayer) Search(pattern map[string]string) (res chan []*Song) { return }
 func (p *mockPlayer) Playing() bool                                       { return false }
+func (p *mockPlayer) Prepare(*Song)                                       {}
+func (p *mockPlayer) Prefetch(*Song)                                      {}
+func (p *mockPlayer) Discard(*Song)                                       {}
+func (p *mockPlayer) Progress() (Progress, error)                         { return Progress{}, ErrNotPlaying }
+func (p *mockPlayer) SetVolume(int) error                                 { return nil }
+func (p *mockPlayer) Seek(float64) error                                  { return nil }
+func (p *mockPlayer) SetAudioFilter(string) error                         { return nil }
 func (p *mockPlayer) Pause()                                              {}
 func (p *mockPlayer) Continue()                                           {}
 func (p *mockPlayer) Stop()                                               {}
 func (p *mockPlayer) LoadPlaylist(string) []*Song                         { return nil }
+func (p *mockPlayer) RandomSong(string) *Song                             { return nil }
+func (p *mockPlayer) Duration(*Song) float64                              { return 0 }
 
 var alice, _ = uuid.NewRandom()
 
@@ -26,7 +51,7 @@ func TestWrmsAdd(t *testing.T) {
 	s1 := NewDummySong("song1", "snfmt")
 	wrms.AddSong(s1)
 
-	if len(wrms.queue) != 1 {
+	if wrms.queue.Len() != 1 {
 		t.Log("len should be 1")
 		t.Fail()
 	}
@@ -44,13 +69,13 @@ func TestWrmsAdd3Next3(t *testing.T) {
 		wrms.AddSong(s)
 	}
 
-	if len(wrms.queue) != len(songs) {
+	if wrms.queue.Len() != len(songs) {
 		t.Log("len should be 3")
 		t.Fail()
 	}
 
 	oq := wrms.queue.OrderedList()
-	t.Logf("pl: %v", wrms.queue)
+	t.Logf("pl: %v", wrms.queue.songs)
 	t.Logf("oq: %v", oq)
 	for _, s := range oq {
 		wrms.Next()
@@ -66,8 +91,8 @@ func TestWrmsAdjust(t *testing.T) {
 	s1 := NewDummySong("song1", "snfmt")
 	wrms.AddSong(s1)
 
-	wrms.AdjustSongWeight(alice, s1.Uri, "up")
-	if wrms.queue[0].Weight != 1 {
+	wrms.AdjustSongWeight(alice, s1.Id, "up")
+	if wrms.queue.songs[0].Weight != 1 {
 		t.Log("song weight should be 1")
 		t.Fail()
 	}
@@ -80,8 +105,8 @@ func TestWrmsUpDownNext(t *testing.T) {
 	wrms.AddSong(s1)
 	wrms.AddSong(s2)
 
-	wrms.AdjustSongWeight(alice, s1.Uri, "down")
-	wrms.AdjustSongWeight(alice, s2.Uri, "up")
+	wrms.AdjustSongWeight(alice, s1.Id, "down")
+	wrms.AdjustSongWeight(alice, s2.Id, "up")
 	wrms.Next()
 	if wrms.CurrentSong.Load().Uri != s2.Uri {
 		t.Log("Not retrning the upvoted song s2")
@@ -98,9 +123,9 @@ func TestWrmsUpUpDownNextNext(t *testing.T) {
 	wrms.AddSong(s2)
 	wrms.AddSong(s3)
 
-	wrms.AdjustSongWeight(alice, s1.Uri, "up")
-	wrms.AdjustSongWeight(alice, s2.Uri, "down")
-	wrms.AdjustSongWeight(alice, s3.Uri, "up")
+	wrms.AdjustSongWeight(alice, s1.Id, "up")
+	wrms.AdjustSongWeight(alice, s2.Id, "down")
+	wrms.AdjustSongWeight(alice, s3.Id, "up")
 	wrms.Next()
 	if wrms.CurrentSong.Load().Uri == s2.Uri {
 		t.Log("Playing the downvoted song s2")
@@ -118,12 +143,12 @@ func TestWrmsDoubleAdd(t *testing.T) {
 	s1 := NewDummySong("song1", "snfmt")
 
 	wrms.AddSong(s1)
-	wrms.AdjustSongWeight(alice, s1.Uri, "up")
+	wrms.AdjustSongWeight(alice, s1.Id, "up")
 	wrms.Next()
 
 	s1 = NewDummySong("song1", "snfmt")
 	wrms.AddSong(s1)
-	wrms.AdjustSongWeight(alice, s1.Uri, "up")
+	wrms.AdjustSongWeight(alice, s1.Id, "up")
 	wrms.Next()
 }
 
@@ -132,12 +157,12 @@ func TestFlipVote(t *testing.T) {
 	s := NewDummySong("song", "snfmt")
 
 	wrms.AddSong(s)
-	wrms.AdjustSongWeight(alice, s.Uri, "up")
+	wrms.AdjustSongWeight(alice, s.Id, "up")
 	if wrms.Songs[0].Weight != 1 {
 		t.Log("Weight is not 1")
 		t.Fail()
 	}
-	wrms.AdjustSongWeight(alice, s.Uri, "down")
+	wrms.AdjustSongWeight(alice, s.Id, "down")
 	if wrms.Songs[0].Weight != -1 {
 		t.Log("Weight is not -1")
 		t.Fail()
@@ -180,11 +205,1542 @@ func TestMultipleAddsOrderedListUpNext(t *testing.T) {
 	_ = wrms.queue.OrderedList()
 
 	s := songs[16]
-	wrms.AdjustSongWeight(alice, s.Uri, "up")
-	t.Logf("queue %v", wrms.queue)
+	wrms.AdjustSongWeight(alice, s.Id, "up")
+	t.Logf("queue %v", wrms.queue.songs)
 	wrms.Next()
 	if wrms.CurrentSong.Load().Uri != s.Uri {
 		t.Logf("Not playing the upvoted song %v", s)
 		t.Fail()
 	}
 }
+
+func TestStateRestore(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "state.json")
+
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.StateFile = stateFile
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	s3 := NewDummySong("song3", "snfmt")
+	s3.AddedBy = alice
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+	wrms.AddSong(s3)
+	wrms.AdjustSongWeight(alice, s2.Id, "up")
+	wrms.Next()
+
+	restored := Wrms{Player: &mockPlayer{}}
+	restored.Config.StateFile = stateFile
+	if !restored.restoreState() {
+		t.Fatal("State was not restored")
+	}
+
+	if restored.CurrentSong.Load().Uri != s2.Uri {
+		t.Logf("Restored current song %v expected: %v", restored.CurrentSong.Load(), s2)
+		t.Fail()
+	}
+
+	oq := wrms.queue.OrderedList()
+	roq := restored.queue.OrderedList()
+	if len(oq) != len(roq) {
+		t.Fatalf("Restored queue %v differs from %v", roq, oq)
+	}
+
+	for i := range oq {
+		if oq[i].Uri != roq[i].Uri || oq[i].Weight != roq[i].Weight {
+			t.Logf("Restored song %v differs from %v", roq[i], oq[i])
+			t.Fail()
+		}
+	}
+
+	if _, ok := restored.CurrentSong.Load().Upvotes[alice]; !ok {
+		t.Log("Upvote of the current song was not restored")
+		t.Fail()
+	}
+
+	if !restored.IsSubmitter(alice, s3.Id) {
+		t.Log("Submitter of s3 was not restored")
+		t.Fail()
+	}
+}
+
+func TestHistory(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+	wrms.AdjustSongWeight(alice, s1.Id, "up")
+
+	// Start playing s1, skip it and let s2 finish
+	wrms.PlayPause()
+	wrms.Next()
+	wrms._lockedNext()
+
+	if len(wrms.History) != 2 {
+		t.Fatalf("History should contain 2 entries: %v", wrms.History)
+	}
+
+	if wrms.History[0].Song != s1 || !wrms.History[0].Skipped || wrms.History[0].Upvotes != 1 {
+		t.Logf("First history entry %v should be the skipped and upvoted s1", wrms.History[0])
+		t.Fail()
+	}
+
+	if wrms.History[1].Song != s2 || wrms.History[1].Skipped {
+		t.Logf("Second history entry %v should be the finished s2", wrms.History[1])
+		t.Fail()
+	}
+
+	page := wrms._historyPage(0, 1)
+	if len(page) != 1 || page[0].Song != s2 {
+		t.Logf("The first history page %v should only contain s2", page)
+		t.Fail()
+	}
+
+	// Huge pages must not overflow
+	if page := wrms._historyPage(math.MaxInt/2, 4); len(page) != 0 {
+		t.Logf("The page after the end of the history %v is not empty", page)
+		t.Fail()
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/history?size=1000000", nil)
+	w := httptest.NewRecorder()
+	wrms.historyHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Logf("Requesting a too large history page did not fail: %d", w.Code)
+		t.Fail()
+	}
+}
+
+func TestContinuousTimeBonus(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.TimeBonus = 1
+	wrms.Config.TimeBonusMode = TIME_BONUS_CONTINUOUS
+
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+
+	// Adding songs must not grant a bonus in continuous mode
+	if s1.Weight != 0 {
+		t.Fatalf("Continuous time bonus applied on add: %v", s1)
+	}
+
+	now := time.Now()
+	s1.Added = now.Add(-2 * time.Minute)
+	s2.Added = now.Add(-1 * time.Minute)
+	wrms.queue.applyWaitBonus(wrms.Config.TimeBonus, now.Add(-time.Hour), now)
+
+	if s1.Weight != 2 || s2.Weight != 1 {
+		t.Logf("Wait bonus not proportional to the waiting time: %v %v", s1, s2)
+		t.Fail()
+	}
+
+	if wrms.queue.PopSong() != s1 {
+		t.Log("The longest waiting song should be played first")
+		t.Fail()
+	}
+}
+
+func TestVoteSkip(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.SkipThreshold = 2
+	bob, _ := uuid.NewRandom()
+
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+	wrms.Next()
+
+	if err := wrms.VoteSkip(alice); err != nil {
+		t.Fatalf("Voting to skip failed: %v", err)
+	}
+
+	if err := wrms.VoteSkip(alice); err == nil {
+		t.Log("Double skip vote was not rejected")
+		t.Fail()
+	}
+
+	if wrms.CurrentSong.Load() != s1 {
+		t.Fatal("Song skipped before reaching the threshold")
+	}
+
+	if err := wrms.VoteSkip(bob); err != nil {
+		t.Fatalf("Voting to skip failed: %v", err)
+	}
+
+	if wrms.CurrentSong.Load() != s2 {
+		t.Fatal("Song not skipped after reaching the threshold")
+	}
+
+	if len(wrms.skipVotes) != 0 {
+		t.Log("Skip votes not reset after skipping")
+		t.Fail()
+	}
+}
+
+func TestAutofillHistory(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.Autofill = []string{AUTOFILL_HISTORY}
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+
+	// Play and finish s1 and s2
+	wrms.PlayPause()
+	wrms._lockedNext()
+	wrms._lockedNext()
+
+	autofilled := wrms.CurrentSong.Load()
+	if autofilled == nil || autofilled.Uri != s1.Uri || autofilled.Autofill != AUTOFILL_HISTORY {
+		t.Fatalf("Autofill should pick s1 from the history not %v", autofilled)
+	}
+
+	s3 := NewDummySong("song3", "snfmt")
+	wrms.AddSong(s3)
+	wrms._lockedNext()
+
+	if wrms.CurrentSong.Load() != s3 {
+		t.Logf("User added song s3 should be played before autofilled songs not %v",
+			wrms.CurrentSong.Load())
+		t.Fail()
+	}
+}
+
+func TestFallbackRepeat(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	f1 := NewDummySong("fallback1", "snfmt")
+	f2 := NewDummySong("fallback2", "snfmt")
+	wrms.fallback = &FallbackPlaylist{Config: FallbackConfig{Repeat: true}, songs: []*Song{f1, f2}}
+	wrms.fallback.refill()
+
+	for _, expected := range []*Song{f1, f2, f1} {
+		wrms.Next()
+		current := wrms.CurrentSong.Load()
+		if current == nil || current.Uri != expected.Uri || current.Autofill != FALLBACK {
+			t.Fatalf("Playing %v instead of the fallback song %v", current, expected)
+		}
+	}
+
+	s := NewDummySong("song", "snfmt")
+	wrms.AddSong(s)
+	wrms.Next()
+	if wrms.CurrentSong.Load() != s {
+		t.Log("The queued song should be played before the fallback playlist")
+		t.Fail()
+	}
+}
+
+func TestSubmitter(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	bob, _ := uuid.NewRandom()
+	s := NewDummySong("song", "snfmt")
+	s.AddedBy = alice
+	wrms.AddSong(s)
+
+	if !wrms.IsSubmitter(alice, s.Id) {
+		t.Log("alice should be the submitter of the song")
+		t.Fail()
+	}
+
+	if wrms.IsSubmitter(bob, s.Id) {
+		t.Log("bob should not be the submitter of the song")
+		t.Fail()
+	}
+
+	data, _ := json.Marshal(s)
+	if strings.Contains(string(data), alice.String()) {
+		t.Logf("The submitter is revealed in the song's JSON: %s", data)
+		t.Fail()
+	}
+}
+
+func TestLimits(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.Limits = LimitsConfig{QueuedPerConnection: 2, Adds: 2, AddWindow: 60}
+	bob, _ := uuid.NewRandom()
+
+	add := func(title string, connId uuid.UUID) error {
+		s := NewDummySong(title, "snfmt")
+		s.AddedBy = connId
+		return wrms.AddSong(s)
+	}
+
+	if err := add("song1", alice); err != nil {
+		t.Fatalf("First add was rejected: %v", err)
+	}
+
+	if err := add("song2", alice); err != nil {
+		t.Fatalf("Second add was rejected: %v", err)
+	}
+
+	if err := add("song3", alice); !errors.Is(err, ErrQuotaExceeded) {
+		t.Log("Third queued song of alice was not rejected")
+		t.Fail()
+	}
+
+	if err := add("song4", bob); err != nil {
+		t.Fatalf("Add of bob was rejected: %v", err)
+	}
+
+	// Playing songs frees the queue quota but not the add rate
+	wrms.Next()
+	wrms.Next()
+	if err := add("song6", alice); !errors.Is(err, ErrQuotaExceeded) {
+		t.Log("Third add of alice during the add window was not rejected")
+		t.Fail()
+	}
+}
+
+func TestPerSourceLimit(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.Limits = LimitsConfig{PerSource: map[string]int{"youtube": 1}}
+	alice, _ := uuid.NewRandom()
+	bob, _ := uuid.NewRandom()
+
+	add := func(title, source string, connId uuid.UUID) error {
+		s := NewSong(title, "snfmt", source, title)
+		s.AddedBy = connId
+		return wrms.AddSong(s)
+	}
+
+	// Songs not added by clients do not count
+	for i := 0; i < 3; i++ {
+		if err := add(fmt.Sprintf("playlist%d", i), "youtube", uuid.Nil); err != nil {
+			t.Fatalf("Adding a playlist song failed: %v", err)
+		}
+	}
+
+	if err := add("song1", "youtube", alice); err != nil {
+		t.Fatalf("First youtube song of alice was rejected: %v", err)
+	}
+
+	if err := add("song2", "youtube", alice); !errors.Is(err, ErrQuotaExceeded) {
+		t.Log("Second youtube song of alice was not rejected")
+		t.Fail()
+	}
+
+	if err := add("song3", "dummy", alice); err != nil {
+		t.Fatalf("Song of another source was rejected: %v", err)
+	}
+
+	if err := add("song4", "youtube", bob); err != nil {
+		t.Fatalf("First youtube song of bob was rejected: %v", err)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.Limits = LimitsConfig{QueuedPerConnection: 1}
+	b := UploadBackend{wrms: &wrms, uploadDir: t.TempDir()}
+	alice := uuid.New()
+
+	upload := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/upload?song=song.mp3", strings.NewReader("not really audio"))
+		r.AddCookie(&http.Cookie{Name: "UUID", Value: alice.String()})
+		w := httptest.NewRecorder()
+		b.upload(w, r)
+		return w.Code
+	}
+
+	if code := upload(); code != http.StatusOK {
+		t.Fatalf("The first upload failed: %d", code)
+	}
+
+	// The rejected upload neither is stored nor removes the file of the queued song
+	if code := upload(); code != http.StatusTooManyRequests {
+		t.Fatalf("The upload exceeding the quota was not rejected: %d", code)
+	}
+
+	files, _ := os.ReadDir(b.uploadDir)
+	if len(files) != 1 || files[0].Name() != wrms.Songs[0].Uri {
+		t.Fatalf("Unexpected uploaded files %v", files)
+	}
+}
+
+func TestDuplicateAdd(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	bob, _ := uuid.NewRandom()
+
+	s1 := NewDummySong("song1", "snfmt")
+	s1.AddedBy = alice
+	wrms.AddSong(s1)
+
+	dup := NewDummySong("song1", "snfmt")
+	dup.AddedBy = bob
+	if err := wrms.AddSong(dup); err != nil {
+		t.Fatalf("Duplicate add was rejected: %v", err)
+	}
+
+	if len(wrms.Songs) != 1 || wrms.queue.Len() != 1 {
+		t.Fatalf("Duplicate was queued: %v", wrms.Songs)
+	}
+
+	if len(s1.Upvotes) != 1 || s1.Weight != 1 {
+		t.Log("Duplicate add did not upvote the queued song")
+		t.Fail()
+	}
+
+	dup = NewDummySong("song1", "snfmt")
+	dup.AddedBy = bob
+	if err := wrms.AddSong(dup); !errors.Is(err, ErrDuplicate) {
+		t.Log("Second duplicate add of bob was not rejected")
+		t.Fail()
+	}
+
+	if len(s1.Upvotes) != 1 {
+		t.Log("Second duplicate add of bob changed the votes")
+		t.Fail()
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.ReplayWindow = 60
+
+	wrms.AddSong(NewDummySong("song1", "snfmt"))
+	wrms.PlayPause()
+
+	if err := wrms.AddSong(NewDummySong("song1", "snfmt")); !errors.Is(err, ErrRecentlyPlayed) {
+		t.Log("Adding the playing song was not rejected")
+		t.Fail()
+	}
+
+	wrms.Next()
+	if err := wrms.AddSong(NewDummySong("song1", "snfmt")); !errors.Is(err, ErrRecentlyPlayed) {
+		t.Log("Adding a recently played song was not rejected")
+		t.Fail()
+	}
+
+	wrms.History[0].Ended = time.Now().Add(-2 * time.Minute)
+	if err := wrms.AddSong(NewDummySong("song1", "snfmt")); err != nil {
+		t.Logf("Adding a song played before the replay window was rejected: %v", err)
+		t.Fail()
+	}
+}
+
+func TestSongIdentity(t *testing.T) {
+	spotify := NewSong("Hey Jude [Remastered 2015]", "The Beatles", "spotify", "a")
+	youtube := NewSong("The Beatles - Hey Jude (Official Video)", "", "youtube", "b")
+	local := NewSong("Héy Jude (feat. Nobody)", "The Beatles & Friends", "local", "c")
+	other := NewSong("Let It Be", "The Beatles", "youtube", "d")
+
+	if !spotify.SameTrack(youtube) || !spotify.SameTrack(local) {
+		t.Logf("Identities differ: %s, %s, %s", spotify.titleIdentity(), youtube.titleIdentity(), local.titleIdentity())
+		t.Fail()
+	}
+
+	if spotify.SameTrack(other) {
+		t.Log("Different tracks are the same track")
+		t.Fail()
+	}
+
+	a := NewSong("Hey Jude", "The Beatles", "spotify", "a")
+	a.Isrc = "GBAYE0601690"
+	b := NewSong("Hey Jude", "The Beatles", "local", "e")
+	b.Isrc = "GBAYE0601691"
+	if a.SameTrack(b) {
+		t.Log("Songs with different ISRCs are the same track")
+		t.Fail()
+	}
+}
+
+func TestCrossSourceDuplicates(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	bob, _ := uuid.NewRandom()
+
+	s1 := NewSong("Hey Jude", "The Beatles", "spotify", "a")
+	s1.AddedBy = alice
+	wrms.AddSong(s1)
+
+	s2 := NewSong("The Beatles - Hey Jude (Official Video)", "", "youtube", "b")
+	s2.AddedBy = bob
+	wrms.AddSong(s2)
+	if len(wrms.Songs) != 2 {
+		t.Fatal("Cross-source duplicate was not added without configured handling")
+	}
+
+	wrms.DeleteSong(s2.Id)
+	wrms.Config.CrossSourceDuplicates = CROSS_SOURCE_MERGE
+	s2 = NewSong("The Beatles - Hey Jude (Official Video)", "", "youtube", "b")
+	s2.AddedBy = bob
+	wrms.AddSong(s2)
+	if len(wrms.Songs) != 1 || len(s1.Upvotes) != 1 {
+		t.Log("Cross-source duplicate was not merged into an upvote")
+		t.Fail()
+	}
+}
+
+func TestCollapseSearchResults(t *testing.T) {
+	in := make(chan []*Song, 2)
+	in <- []*Song{NewSong("Hey Jude", "The Beatles", "spotify", "a"),
+		NewSong("Hey Jude", "The Beatles", "spotify", "live")}
+	in <- []*Song{NewSong("The Beatles - Hey Jude (Official Video)", "", "youtube", "b"),
+		NewSong("Let It Be", "The Beatles", "youtube", "c")}
+	close(in)
+
+	var results []*Song
+	for r := range collapseSearchResults(in) {
+		results = append(results, r...)
+	}
+
+	if len(results) != 3 || results[2].Uri != "c" {
+		t.Logf("Search results were not collapsed correctly: %v", results)
+		t.Fail()
+	}
+}
+
+func TestQueueEntryIds(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.AllowDuplicates = true
+
+	local := NewSong("song", "artist", "local", "song.mp3")
+	upload := NewSong("song", "artist", "upload", "song.mp3")
+	dup := NewSong("song", "artist", "local", "song.mp3")
+	for _, s := range []*Song{local, upload, dup} {
+		if err := wrms.AddSong(s); err != nil {
+			t.Fatalf("Adding %v failed: %v", s, err)
+		}
+	}
+
+	if len(wrms.Songs) != 3 || local.Id == dup.Id || local.Id == upload.Id {
+		t.Fatalf("Songs are not separate queue entries: %v", wrms.Songs)
+	}
+
+	wrms.AdjustSongWeight(alice, dup.Id, "up")
+	if len(local.Upvotes) != 0 || len(dup.Upvotes) != 1 {
+		t.Log("Vote was not applied to the voted entry only")
+		t.Fail()
+	}
+
+	wrms.DeleteSong(local.Id)
+	if len(wrms.Songs) != 2 || wrms._songIndex(upload.Id) < 0 || wrms._songIndex(dup.Id) < 0 {
+		t.Logf("Deleting an entry removed the wrong songs: %v", wrms.Songs)
+		t.Fail()
+	}
+}
+
+func TestPinSong(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "state.json")
+
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.StateFile = stateFile
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	s3 := NewDummySong("song3", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+	wrms.AddSong(s3)
+	wrms.AdjustSongWeight(alice, s2.Id, "up")
+
+	if err := wrms.PinSong(s3.Id); err != nil {
+		t.Fatalf("Pinning a queued song failed: %v", err)
+	}
+
+	if err := wrms.PinSong("unknown"); !errors.Is(err, ErrNotQueued) {
+		t.Log("Pinning an unknown song did not fail")
+		t.Fail()
+	}
+
+	if order := wrms._queueOrder(); len(order) != 3 || order[0] != s3.Id || order[1] != s2.Id {
+		t.Logf("Queue order %v does not start with the pinned song", order)
+		t.Fail()
+	}
+
+	restored := Wrms{Player: &mockPlayer{}}
+	restored.Config.StateFile = stateFile
+	if !restored.restoreState() {
+		t.Fatal("State was not restored")
+	}
+
+	restored.Next()
+	if restored.CurrentSong.Load().Id != s3.Id {
+		t.Logf("Restored queue did not play the pinned song first but %v", restored.CurrentSong.Load())
+		t.Fail()
+	}
+}
+
+func TestBans(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	queued := NewSong("Hey Jude", "The Beatles", "spotify", "a")
+	wrms.AddSong(queued)
+
+	if err := wrms.UpdateBans(BAN_ARTIST, "the beatles", true); err != nil {
+		t.Fatalf("Banning an artist failed: %v", err)
+	}
+
+	if len(wrms.Songs) != 0 || wrms.queue.Queued() != 0 {
+		t.Log("Banning an artist did not remove its queued songs")
+		t.Fail()
+	}
+
+	if err := wrms.UpdateBans(BAN_PATTERN, "(?i)christmas", true); err != nil {
+		t.Fatalf("Banning a pattern failed: %v", err)
+	}
+
+	if err := wrms.UpdateBans(BAN_PATTERN, "(", true); err == nil {
+		t.Log("Banning an invalid pattern did not fail")
+		t.Fail()
+	}
+
+	if err := wrms.UpdateBans(BAN_SONG, "youtube:b", true); err != nil {
+		t.Fatalf("Banning a song failed: %v", err)
+	}
+
+	for _, s := range []*Song{
+		NewSong("The Beatles - Let It Be", "", "youtube", "c"),
+		NewSong("Last Christmas", "Wham!", "local", "d"),
+		NewSong("Some Song", "Someone", "youtube", "b"),
+	} {
+		if err := wrms.AddSong(s); !errors.Is(err, ErrBanned) {
+			t.Logf("Adding the banned song %v was not rejected", s)
+			t.Fail()
+		}
+	}
+
+	if err := wrms.UpdateBans(BAN_SONG, "youtube:b", false); err != nil {
+		t.Fatalf("Unbanning a song failed: %v", err)
+	}
+
+	if err := wrms.AddSong(NewSong("Some Song", "Someone", "youtube", "b")); err != nil {
+		t.Logf("Adding an unbanned song failed: %v", err)
+		t.Fail()
+	}
+
+	in := make(chan []*Song, 1)
+	in <- []*Song{NewSong("Hey Jude", "The Beatles", "spotify", "a"),
+		NewSong("Some Song", "Someone", "local", "e")}
+	close(in)
+
+	var results []*Song
+	for r := range wrms.filterBanned(in) {
+		results = append(results, r...)
+	}
+
+	if len(results) != 1 || results[0].Uri != "e" {
+		t.Logf("Search results %v were not filtered", results)
+		t.Fail()
+	}
+}
+
+func TestSaveBans(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yml")
+	data := "# The port\nport: 8080\nbans:\n  artists:\n    - Abba\nrooms:\n  party:\n    skip-threshold: 2\n"
+	if err := os.WriteFile(configPath, []byte(data), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	config := loadConfig(configPath)
+	party, err := config.roomConfig("party", config.Rooms["party"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultRoom, err := config.roomConfig(DEFAULT_ROOM, config.Rooms[DEFAULT_ROOM])
+	if err != nil {
+		t.Fatal(err)
+	}
+	adhoc, _ := config.roomConfig("adhoc", yaml.Node{})
+
+	defaultRoom.Bans.Add(BAN_ARTIST, "Nickelback")
+	party.Bans.Add(BAN_SONG, "youtube:b")
+	party.Bans.Remove(BAN_ARTIST, "Abba")
+	adhoc.Bans.Add(BAN_SONG, "youtube:c")
+	for room, c := range map[string]Config{DEFAULT_ROOM: defaultRoom, "party": party, "adhoc": adhoc} {
+		if err := c.saveBans(room); err != nil {
+			t.Fatalf("Saving the ban list of room %s failed: %v", room, err)
+		}
+	}
+
+	saved := loadConfig(configPath)
+	savedDefault, _ := saved.roomConfig(DEFAULT_ROOM, saved.Rooms[DEFAULT_ROOM])
+	savedParty, _ := saved.roomConfig("party", saved.Rooms["party"])
+	if !slices.Equal(saved.Bans.Artists, []string{"Abba"}) || len(saved.Bans.Songs) != 0 {
+		t.Logf("The inherited ban list %v was changed", saved.Bans)
+		t.Fail()
+	}
+
+	if !slices.Equal(savedDefault.Bans.Artists, []string{"Abba", "Nickelback"}) {
+		t.Logf("Saved ban list of the default room %v differs", savedDefault.Bans)
+		t.Fail()
+	}
+
+	if !slices.Equal(savedParty.Bans.Songs, []string{"youtube:b"}) || len(savedParty.Bans.Artists) != 0 ||
+		savedParty.SkipThreshold != 2 {
+		t.Logf("Saved room config %v differs", savedParty)
+		t.Fail()
+	}
+
+	if _, ok := saved.Rooms["adhoc"]; ok {
+		t.Log("Saving the ban list made a room created at runtime permanent")
+		t.Fail()
+	}
+
+	raw, _ := os.ReadFile(configPath)
+	if !strings.Contains(string(raw), "# The port") {
+		t.Log("Saving the ban list dropped comments from the config")
+		t.Fail()
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	wrms.Config.MaxDuration = 600
+
+	mix := NewDummySong("3 hour mix", "snfmt")
+	mix.Duration = 3 * 60 * 60
+	if err := wrms.AddSong(mix); !errors.Is(err, ErrTooLong) {
+		t.Log("Adding a too long song was not rejected")
+		t.Fail()
+	}
+
+	track := NewDummySong("track", "snfmt")
+	track.Duration = 180
+	if err := wrms.AddSong(track); err != nil {
+		t.Logf("Adding a short song failed: %v", err)
+		t.Fail()
+	}
+
+	if err := wrms.AddSong(NewDummySong("unknown", "snfmt")); !errors.Is(err, ErrUnknownDuration) {
+		t.Log("Adding a song with unknown duration was not rejected")
+		t.Fail()
+	}
+}
+
+// Player whose backends know the duration of all songs
+type durationPlayer struct {
+	mockPlayer
+	duration float64
+}
+
+func (p *durationPlayer) Duration(*Song) float64 { return p.duration }
+
+func TestMaxDurationPosted(t *testing.T) {
+	wrms := Wrms{Player: &durationPlayer{duration: 3 * 60 * 60}}
+	wrms.Config.MaxDuration = 600
+
+	// The duration posted by the client is ignored
+	mix := NewDummySong("3 hour mix", "snfmt")
+	mix.Duration = 180
+	data, _ := json.Marshal(mix)
+	r := httptest.NewRequest(http.MethodPost, "/add", bytes.NewReader(data))
+	r.AddCookie(&http.Cookie{Name: "UUID", Value: uuid.New().String()})
+	w := httptest.NewRecorder()
+
+	wrms.addHandler(w, r)
+	if w.Code != http.StatusBadRequest || len(wrms.Songs) != 0 {
+		t.Fatalf("Added a too long song posted with a wrong duration: %d", w.Code)
+	}
+}
+
+func TestAddedPosted(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}, queue: NewPlaylist(HotRanking{})}
+	s1 := NewDummySong("song1", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AdjustSongWeight(uuid.New(), s1.Id, "up")
+
+	// A song claiming to be added in the future would always be the hottest
+	s2 := NewDummySong("song2", "snfmt")
+	s2.Added = time.Now().Add(365 * 24 * time.Hour)
+	s2.Autofill = "playlist"
+	data, _ := json.Marshal(s2)
+	r := httptest.NewRequest(http.MethodPost, "/add", bytes.NewReader(data))
+	r.AddCookie(&http.Cookie{Name: "UUID", Value: uuid.New().String()})
+	w := httptest.NewRecorder()
+
+	wrms.addHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Adding the song failed: %d %s", w.Code, w.Body.String())
+	}
+
+	posted := wrms.Songs[1]
+	if posted.Added.After(time.Now()) || posted.Autofill != "" {
+		t.Logf("The posted added time %v or autofill %q was kept", posted.Added, posted.Autofill)
+		t.Fail()
+	}
+
+	if next := wrms.queue.Peek(); next != s1 {
+		t.Logf("The posted song outranked the older song: %v", next)
+		t.Fail()
+	}
+}
+
+// Player keeping paused songs loaded
+type pausingPlayer struct{ mockPlayer }
+
+func (p *pausingPlayer) Playing() bool { return true }
+
+func TestProgress(t *testing.T) {
+	wrms := Wrms{Player: &pausingPlayer{}}
+	s := NewDummySong("song", "snfmt")
+	s.Duration = 200
+	wrms.AddSong(s)
+
+	wrms.PlayPause()
+	// Pretend the song started 10 seconds ago
+	wrms.startedAt = wrms.startedAt.Add(-10 * time.Second)
+
+	p := wrms._progress()
+	if p == nil || p.Paused || p.Duration != 200 || p.Position < 10 || p.Position > 11 {
+		t.Logf("Unexpected progress %v of the playing song", p)
+		t.Fail()
+	}
+
+	ev := Event{}
+	wrms._addProgress(&ev)
+	if ev.StartedAt == nil || !ev.StartedAt.Equal(wrms.startedAt) {
+		t.Log("The event of the playing song has no start time")
+		t.Fail()
+	}
+
+	wrms.PlayPause()
+	// Pretend the song was paused for a minute
+	wrms.pausedAt = wrms.pausedAt.Add(-time.Minute)
+	wrms.startedAt = wrms.startedAt.Add(-time.Minute)
+
+	ev = Event{}
+	wrms._addProgress(&ev)
+	if ev.Progress == nil || !ev.Progress.Paused || ev.StartedAt != nil {
+		t.Logf("Unexpected progress %v of the paused song", ev.Progress)
+		t.Fail()
+	}
+
+	wrms.PlayPause()
+	if p := wrms._progress(); p.Paused || p.Position < 10 || p.Position > 11 {
+		t.Logf("The paused time was counted in the progress %v", p)
+		t.Fail()
+	}
+
+	wrms.Next()
+	if p := wrms._progress(); p != nil {
+		t.Logf("Progress %v reported without a current song", p)
+		t.Fail()
+	}
+}
+
+func TestAudioControls(t *testing.T) {
+	wrms := Wrms{Player: &pausingPlayer{}}
+	wrms.Config.AudioFilters = map[string]string{"night": "lavfi=[acompressor]"}
+
+	if err := wrms.SetVolume(50); err != nil || wrms.volume != 50 {
+		t.Logf("Setting the volume failed: %v", err)
+		t.Fail()
+	}
+
+	if err := wrms.SetVolume(150); err == nil || wrms.volume != 50 {
+		t.Log("An invalid volume was accepted")
+		t.Fail()
+	}
+
+	if err := wrms.SetAudioFilter("night"); err != nil || wrms.audioFilter != "night" {
+		t.Logf("Applying the night preset failed: %v", err)
+		t.Fail()
+	}
+
+	if err := wrms.SetAudioFilter("party"); !errors.Is(err, ErrUnknownPreset) || wrms.audioFilter != "night" {
+		t.Log("An unknown preset was accepted")
+		t.Fail()
+	}
+
+	if err := wrms.SetAudioFilter(""); err != nil || wrms.audioFilter != "" {
+		t.Logf("Removing the audio filter failed: %v", err)
+		t.Fail()
+	}
+
+	if err := wrms.Seek(10); !errors.Is(err, ErrNotPlaying) {
+		t.Log("Seeking without a current song did not fail")
+		t.Fail()
+	}
+
+	s := NewDummySong("song", "snfmt")
+	s.Duration = 200
+	wrms.AddSong(s)
+	wrms.PlayPause()
+
+	if err := wrms.Seek(300); err == nil {
+		t.Log("Seeking beyond the end of the song did not fail")
+		t.Fail()
+	}
+
+	if err := wrms.Seek(60); err != nil {
+		t.Logf("Seeking failed: %v", err)
+		t.Fail()
+	}
+
+	if p := wrms._progress(); p.Position < 60 || p.Position > 61 {
+		t.Logf("The progress %v does not reflect the seek", p)
+		t.Fail()
+	}
+}
+
+// Player recording the songs it was asked to prepare
+type preparingPlayer struct {
+	mockPlayer
+	prepared []*Song
+}
+
+func (p *preparingPlayer) Prepare(s *Song) { p.prepared = append(p.prepared, s) }
+
+func TestPrepareNext(t *testing.T) {
+	player := &preparingPlayer{}
+	wrms := Wrms{Player: player}
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	s3 := NewDummySong("song3", "snfmt")
+	for _, s := range []*Song{s1, s2, s3} {
+		wrms.AddSong(s)
+	}
+
+	wrms.PlayPause()
+	wrms.PrepareNext(s1)
+	if len(player.prepared) != 1 || player.prepared[0] != s2 {
+		t.Fatalf("Prepared %v instead of the top song", player.prepared)
+	}
+
+	// Only the current song can be followed by a prepared song
+	wrms.PrepareNext(s3)
+	if len(player.prepared) != 1 {
+		t.Fatal("Prepared a song for a song not playing")
+	}
+
+	// The late vote decides which song follows
+	wrms.AdjustSongWeight(alice, s3.Id, "up")
+	wrms.SongFinished(s1)
+	if wrms.CurrentSong.Load() != s3 {
+		t.Fatalf("Playing %v instead of the new top song", wrms.CurrentSong.Load())
+	}
+
+	// A song skipped meanwhile does not advance the queue again
+	wrms.SongFinished(s1)
+	if wrms.CurrentSong.Load() != s3 || wrms.queue.Len() != 1 {
+		t.Fatal("The end of a replaced song advanced the queue")
+	}
+}
+
+type prefetchingPlayer struct {
+	mockPlayer
+	prefetched []*Song
+	discarded  []*Song
+}
+
+func (p *prefetchingPlayer) Prefetch(s *Song) { p.prefetched = append(p.prefetched, s) }
+func (p *prefetchingPlayer) Discard(s *Song)  { p.discarded = append(p.discarded, s) }
+
+func TestPrefetchNext(t *testing.T) {
+	player := &prefetchingPlayer{}
+	wrms := Wrms{Player: player}
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	s3 := NewDummySong("song3", "snfmt")
+	for _, s := range []*Song{s1, s2} {
+		wrms.AddSong(s)
+	}
+
+	// Nothing is prefetched before a song plays
+	if len(player.prefetched) != 0 {
+		t.Fatalf("Prefetched %v without a current song", player.prefetched)
+	}
+
+	wrms.PlayPause()
+	if len(player.prefetched) != 1 || player.prefetched[0] != s2 {
+		t.Fatalf("Prefetched %v instead of the top song", player.prefetched)
+	}
+
+	// A new top song replaces the prefetched song
+	wrms.AddSong(s3)
+	wrms.AdjustSongWeight(alice, s3.Id, "up")
+	if len(player.prefetched) != 2 || player.prefetched[1] != s3 {
+		t.Fatalf("Did not prefetch the new top song: %v", player.prefetched)
+	}
+	if len(player.discarded) != 1 || player.discarded[0] != s2 {
+		t.Fatalf("Did not discard the voted down song: %v", player.discarded)
+	}
+
+	// The prefetched song is played and not discarded
+	wrms.Next()
+	if wrms.CurrentSong.Load() != s3 {
+		t.Fatalf("Playing %v instead of the prefetched song", wrms.CurrentSong.Load())
+	}
+	if slices.Contains(player.discarded, s3) {
+		t.Fatal("Discarded the prefetched song when playing it")
+	}
+	if player.prefetched[len(player.prefetched)-1] != s2 {
+		t.Fatal("Did not prefetch the following song")
+	}
+
+	// The last song has no successor to prefetch
+	wrms.Next()
+	if wrms.prefetched != nil {
+		t.Fatalf("Prefetched %v with an empty queue", wrms.prefetched)
+	}
+}
+
+func TestPrefetchCache(t *testing.T) {
+	var released []string
+	c := newPrefetchCache(func(v string) { released = append(released, v) })
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+
+	fetch := func(v string) func(context.Context) (string, error) {
+		return func(context.Context) (string, error) { return v, nil }
+	}
+
+	c.Start(s1, fetch("first"))
+	// Prefetching a song twice keeps the first result
+	c.Start(s1, fetch("second"))
+	if v, ok := c.Take(s1); !ok || v != "first" {
+		t.Fatalf("Took %q instead of the prefetched value", v)
+	}
+	if _, ok := c.Take(s1); ok {
+		t.Fatal("Took the prefetched value twice")
+	}
+
+	// A canceled fetch is not released
+	blocked := make(chan struct{})
+	c.Start(s2, func(ctx context.Context) (string, error) {
+		defer close(blocked)
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	c.Discard(s2)
+	<-blocked
+	if _, ok := c.Take(s2); ok {
+		t.Fatal("Took a discarded song")
+	}
+
+	done := make(chan struct{})
+	c.release = func(v string) {
+		released = append(released, v)
+		close(done)
+	}
+	c.Start(s1, fetch("third"))
+	c.Discard(s1)
+	<-done
+	if len(released) != 1 || released[0] != "third" {
+		t.Fatalf("Released %v instead of the discarded value", released)
+	}
+}
+
+func TestSongFailed(t *testing.T) {
+	wrms := Wrms{Player: &mockPlayer{}}
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	for _, s := range []*Song{s1, s2} {
+		wrms.AddSong(s)
+	}
+
+	wrms.PlayPause()
+	wrms.SongFailed(s1, errors.New("unplayable"))
+	if wrms.CurrentSong.Load() != s2 {
+		t.Fatalf("Did not skip the failed song: playing %v", wrms.CurrentSong.Load())
+	}
+	if len(wrms.History) != 1 || wrms.History[0].Song != s1 || !wrms.History[0].Skipped {
+		t.Fatalf("The failed song is not recorded as skipped: %v", wrms.History)
+	}
+
+	// The failure of a song no longer playing does not skip the current song
+	wrms.SongFailed(s1, errors.New("unplayable"))
+	if wrms.CurrentSong.Load() != s2 || len(wrms.History) != 1 {
+		t.Fatal("The late failure of a replaced song skipped the current song")
+	}
+}
+
+// Fails to play the songs of the "broken*" sources
+type failingPlayer struct{ mockPlayer }
+
+func (p *failingPlayer) Play(s *Song) error {
+	if strings.HasPrefix(s.Source, "broken") {
+		return errors.New("backend failure")
+	}
+	return nil
+}
+
+func TestPlayFailed(t *testing.T) {
+	wrms := Wrms{Player: &failingPlayer{}}
+	s1 := NewSong("song1", "snfmt", "broken", "1")
+	s2 := NewDummySong("song2", "snfmt")
+	wrms.AddSong(s1)
+	wrms.AddSong(s2)
+
+	// The failed song is skipped
+	wrms.PlayPause()
+	if wrms.CurrentSong.Load() != s2 || !wrms.playing {
+		t.Fatalf("Did not continue with the next song: playing %v", wrms.CurrentSong.Load())
+	}
+	if len(wrms.History) != 1 || wrms.History[0].Song != s1 || !wrms.History[0].Skipped {
+		t.Fatalf("The failed song is not recorded as skipped: %v", wrms.History)
+	}
+
+	// Repeated failures mark the backend unhealthy
+	for i := 0; i < BACKEND_FAILURES_BEFORE_UNHEALTHY-1; i++ {
+		wrms.AddSong(NewSong(fmt.Sprintf("broken%d", i), "snfmt", "broken", fmt.Sprint(i+2)))
+		wrms.Next()
+	}
+	if !errors.Is(wrms._checkBackendHealth("broken"), ErrBackendUnhealthy) {
+		t.Fatal("The repeatedly failing backend is not marked unhealthy")
+	}
+	if wrms._checkBackendHealth("dummy") != nil {
+		t.Fatal("A working backend is marked unhealthy")
+	}
+
+	// The songs of an unhealthy backend stay queued
+	s3 := NewSong("song3", "snfmt", "broken", "song3")
+	s4 := NewDummySong("song4", "snfmt")
+	wrms.AddSong(s3)
+	wrms.AddSong(s4)
+	if wrms.CurrentSong.Load() != s4 || wrms.queue.Peek() != s3 {
+		t.Fatalf("Did not keep the song of the unhealthy backend queued: playing %v", wrms.CurrentSong.Load())
+	}
+
+	// The kept songs are tried again once the backend recovered
+	wrms.backendHealth["broken"].retryAt = time.Now()
+	wrms.Next()
+	if last := wrms.History[len(wrms.History)-1]; last.Song != s3 || wrms.queue.Queued() != 0 {
+		t.Fatalf("Did not try the kept song after the backend recovered: %v", last.Song)
+	}
+}
+
+func TestPlayFailedPauses(t *testing.T) {
+	wrms := Wrms{Player: &failingPlayer{}}
+	for i := 0; i < MAX_FAILED_PLAYS+1; i++ {
+		wrms.AddSong(NewSong(fmt.Sprintf("broken%d", i), "snfmt", fmt.Sprintf("broken%d", i), fmt.Sprint(i)))
+	}
+
+	// Failing songs do not empty the whole queue
+	wrms.PlayPause()
+	if wrms.playing {
+		t.Fatal("Still playing after all songs failed")
+	}
+	if len(wrms.History) != MAX_FAILED_PLAYS || wrms.queue.Len() != 0 {
+		t.Fatalf("Skipped %d songs with %d left", len(wrms.History), wrms.queue.Len())
+	}
+}
+
+func TestPlayFailedWithUnservedConnection(t *testing.T) {
+	wrms := Wrms{Player: &failingPlayer{}}
+	for i := 0; i < MAX_FAILED_PLAYS+1; i++ {
+		wrms.AddSong(NewSong(fmt.Sprintf("broken%d", i), "snfmt", fmt.Sprintf("broken%d", i), fmt.Sprint(i)))
+	}
+
+	// A registered connection is only served after it was initialized
+	conn := &Connection{Id: uuid.New(), Events: make(chan Event, EVENT_BUFFER_SIZE)}
+	wrms.Connections.Store(conn.Id, conn)
+
+	done := make(chan struct{})
+	go func() {
+		wrms.PlayPause()
+		close(done)
+	}()
+
+	// Initialize the connection like initConn once its events are piling up
+	go func() {
+		for len(conn.Events) < EVENT_BUFFER_SIZE {
+			time.Sleep(time.Millisecond)
+		}
+		wrms.rwlock.RLock()
+		wrms.rwlock.RUnlock()
+		for {
+			select {
+			case <-conn.Events:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failing songs blocked the rwlock while broadcasting")
+	}
+}
+
+func newTestRooms(t *testing.T, config string) *Rooms {
+	var c Config
+	if err := yaml.Unmarshal([]byte(config), &c); err != nil {
+		t.Fatalf("Parsing the config failed: %v", err)
+	}
+	return newRooms(c, func(*Wrms) Player { return &mockPlayer{} })
+}
+
+func roomsRequest(rooms *Rooms, method, target string, body io.Reader, id uuid.UUID) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	r.AddCookie(&http.Cookie{Name: "UUID", Value: id.String()})
+	w := httptest.NewRecorder()
+	rooms.mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestRooms(t *testing.T) {
+	rooms := newTestRooms(t, fmt.Sprintf(`
+admins: [%s]
+rooms:
+  office:
+    time-bonus: 0.5
+`, alice))
+
+	office := rooms.Get("office")
+	if office == nil || office.Name != "office" || office.Config.TimeBonus != 0.5 {
+		t.Fatalf("The configured room was not created: %v", office)
+	}
+
+	if !rooms.Get(DEFAULT_ROOM).Config.IsAdmin(alice) || office.Config.IsAdmin(alice) {
+		t.Log("The top-level admins should only administrate the default room")
+		t.Fail()
+	}
+
+	bob := uuid.New()
+	if w := roomsRequest(rooms, http.MethodPost, "/rooms?name=party", nil, bob); w.Code != http.StatusUnauthorized {
+		t.Logf("A room was created by a non admin: %d", w.Code)
+		t.Fail()
+	}
+
+	if w := roomsRequest(rooms, http.MethodPost, "/rooms?name=party", nil, alice); w.Code != http.StatusOK {
+		t.Fatalf("Creating a room failed: %d %s", w.Code, w.Body.String())
+	}
+
+	party := rooms.Get("party")
+	if party == nil || !party.Config.IsAdmin(alice) {
+		t.Fatal("The created room is not administrated by its creator")
+	}
+
+	for _, name := range []string{"party", "../party", ""} {
+		w := roomsRequest(rooms, http.MethodPost, "/rooms?name="+name, nil, alice)
+		if w.Code != http.StatusBadRequest {
+			t.Logf("Creating the room %q did not fail: %d", name, w.Code)
+			t.Fail()
+		}
+	}
+
+	w := roomsRequest(rooms, http.MethodGet, "/rooms", nil, bob)
+	var names []string
+	if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+		t.Fatalf("Decoding the room list failed: %v", err)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{DEFAULT_ROOM, "office", "party"}) {
+		t.Logf("Unexpected rooms %v", names)
+		t.Fail()
+	}
+}
+
+func TestRoomsRouting(t *testing.T) {
+	rooms := newTestRooms(t, `
+rooms:
+  office: {}
+`)
+	def, office := rooms.Get(DEFAULT_ROOM), rooms.Get("office")
+
+	add := func(target string, song *Song) {
+		data, _ := json.Marshal(song)
+		if w := roomsRequest(rooms, http.MethodPost, target, bytes.NewReader(data), alice); w.Code != http.StatusOK {
+			t.Fatalf("Adding %v via %s failed: %d %s", song, target, w.Code, w.Body.String())
+		}
+	}
+
+	s1 := NewDummySong("song1", "snfmt")
+	s2 := NewDummySong("song2", "snfmt")
+	add("/r/office/add", s1)
+	add("/add", s2)
+
+	if len(office.Songs) != 1 || !office.Songs[0].SameTrack(s1) {
+		t.Logf("The office queue should only contain %v: %v", s1, office.Songs)
+		t.Fail()
+	}
+
+	if len(def.Songs) != 1 || !def.Songs[0].SameTrack(s2) {
+		t.Logf("The default queue should only contain %v: %v", s2, def.Songs)
+		t.Fail()
+	}
+
+	// Votes and playing stay in their room
+	weight, officeWeight := def.Songs[0].Weight, office.Songs[0].Weight
+	roomsRequest(rooms, http.MethodPost, "/r/office/up?id="+office.Songs[0].Id, nil, uuid.New())
+	if office.Songs[0].Weight == officeWeight {
+		t.Log("Voting in the office room failed")
+		t.Fail()
+	}
+
+	office.Next()
+	if def.Songs[0].Weight != weight || def.CurrentSong.Load() != nil {
+		t.Log("Changing the office room changed the default room")
+		t.Fail()
+	}
+
+	if cur := office.CurrentSong.Load(); cur == nil || !cur.SameTrack(s1) || len(office.Songs) != 0 {
+		t.Logf("The office room did not play its song: %v %v", cur, office.Songs)
+		t.Fail()
+	}
+}
+
+func TestBackendPool(t *testing.T) {
+	pool := backendPool{backends: map[string]Backend{}}
+	created := 0
+	create := func() (Backend, error) {
+		created++
+		return &DummyBackend{}, nil
+	}
+
+	b1, _ := pool.get("dummy", create)
+	b2, _ := pool.get("dummy", create)
+	if b1 != b2 || created != 1 {
+		t.Log("Rooms with the same backend configuration do not share the backend")
+		t.Fail()
+	}
+
+	if _, err := pool.get("broken", func() (Backend, error) { return nil, errors.New("login failed") }); err == nil {
+		t.Log("The failed creation of a backend was not reported")
+		t.Fail()
+	}
+
+	if b, err := pool.get("broken", create); err != nil || b == nil || created != 2 {
+		t.Log("A backend whose creation failed was not created again")
+		t.Fail()
+	}
+}
+
+// The mpv end of an IPC connection
+type fakeMpv struct {
+	conn     net.Conn
+	requests *bufio.Scanner
+}
+
+type fakeMpvRequest struct {
+	Command   []any `json:"command"`
+	RequestId int64 `json:"request_id"`
+}
+
+func newFakeMpv(t *testing.T) (*fakeMpv, *mpvConn) {
+	socket := path.Join(t.TempDir(), "mpv.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listening on %s failed: %v", socket, err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	c, err := dialMpv(socket, time.Second)
+	if err != nil {
+		t.Fatalf("Connecting to the fake mpv failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	conn, ok := <-accepted
+	if !ok {
+		t.Fatal("Accepting the mpv connection failed")
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &fakeMpv{conn: conn, requests: bufio.NewScanner(conn)}, c
+}
+
+func (m *fakeMpv) read(t *testing.T) fakeMpvRequest {
+	if !m.requests.Scan() {
+		t.Fatalf("Reading the mpv command failed: %v", m.requests.Err())
+	}
+
+	var req fakeMpvRequest
+	if err := json.Unmarshal(m.requests.Bytes(), &req); err != nil {
+		t.Fatalf("Parsing the mpv command %s failed: %v", m.requests.Text(), err)
+	}
+	return req
+}
+
+func (m *fakeMpv) send(msg string) {
+	fmt.Fprintln(m.conn, msg)
+}
+
+// Answer a get_property request with the name of the property
+func (m *fakeMpv) reply(req fakeMpvRequest) {
+	m.send(fmt.Sprintf(`{"request_id":%d,"error":"success","data":%q}`, req.RequestId, req.Command[1]))
+}
+
+func TestMpvConnReplies(t *testing.T) {
+	mpv, c := newFakeMpv(t)
+
+	names := []string{"volume", "pause", "playlist"}
+	results := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) {
+			data, err := c.Command("get_property", name)
+			if err == nil && string(data) != `"`+name+`"` {
+				err = fmt.Errorf("received the reply %s for the property %s", data, name)
+			}
+			results <- err
+		}(name)
+	}
+
+	var requests []fakeMpvRequest
+	for range names {
+		requests = append(requests, mpv.read(t))
+	}
+
+	// Answer in reverse order with an event in between
+	mpv.send(`{"event":"idle"}`)
+	for i := len(requests) - 1; i >= 0; i-- {
+		mpv.reply(requests[i])
+	}
+
+	for range names {
+		if err := <-results; err != nil {
+			t.Logf("Matching the mpv replies failed: %v", err)
+			t.Fail()
+		}
+	}
+
+	if ev := <-c.Events; ev.Event != "idle" {
+		t.Logf("Unexpected mpv event %v", ev)
+		t.Fail()
+	}
+
+	go func() {
+		_, err := c.Command("get_property", "missing")
+		results <- err
+	}()
+	req := mpv.read(t)
+	mpv.send(fmt.Sprintf(`{"request_id":%d,"error":"property unavailable"}`, req.RequestId))
+	if err := <-results; err == nil || !strings.Contains(err.Error(), "property unavailable") {
+		t.Logf("The mpv error was not reported: %v", err)
+		t.Fail()
+	}
+}
+
+func TestMpvConnTimeout(t *testing.T) {
+	mpv, c := newFakeMpv(t)
+	c.timeout = 50 * time.Millisecond
+
+	if _, err := c.Command("get_property", "volume"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("The unanswered mpv command did not time out: %v", err)
+	}
+
+	c.lock.Lock()
+	pending := len(c.pending)
+	c.lock.Unlock()
+	if pending != 0 {
+		t.Logf("The timed out command is still waiting for its reply")
+		t.Fail()
+	}
+
+	// The late reply is dropped and not taken for the reply of the next command
+	late := mpv.read(t)
+	results := make(chan error, 1)
+	go func() {
+		data, err := c.Command("get_property", "pause")
+		if err == nil && string(data) != `"pause"` {
+			err = fmt.Errorf("received the reply %s", data)
+		}
+		results <- err
+	}()
+
+	req := mpv.read(t)
+	mpv.reply(late)
+	mpv.reply(req)
+	if err := <-results; err != nil {
+		t.Logf("The command after the timeout failed: %v", err)
+		t.Fail()
+	}
+}
+
+func TestMpvConnClosed(t *testing.T) {
+	mpv, c := newFakeMpv(t)
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.Command("get_property", "volume")
+			results <- err
+		}()
+	}
+
+	mpv.read(t)
+	mpv.read(t)
+	mpv.conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; !errors.Is(err, ErrMpvGone) {
+			t.Logf("The pending command did not fail with ErrMpvGone: %v", err)
+			t.Fail()
+		}
+	}
+
+	if _, ok := <-c.Events; ok {
+		t.Log("The events of the closed connection were not closed")
+		t.Fail()
+	}
+
+	if _, err := c.Command("get_property", "volume"); !errors.Is(err, ErrMpvGone) {
+		t.Logf("Sending to the closed connection did not fail with ErrMpvGone: %v", err)
+		t.Fail()
+	}
+}
+
+func TestMpvBackoff(t *testing.T) {
+	p := &MpvPlayer{wrms: &Wrms{Player: &mockPlayer{}}}
+
+	for i := 1; i < MPV_FAILURES_BEFORE_BACKOFF; i++ {
+		p._mpvFailed(ErrMpvExited)
+		if !p.retryAt.IsZero() {
+			t.Fatalf("mpv is not started again after %d failures", i)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		start := time.Now()
+		p._mpvFailed(ErrMpvExited)
+
+		expected := MPV_MIN_BACKOFF << i
+		if expected > MPV_MAX_BACKOFF {
+			expected = MPV_MAX_BACKOFF
+		}
+
+		backoff := p.retryAt.Sub(start)
+		if backoff < expected || backoff > expected+time.Second {
+			t.Logf("Expected a backoff of %v after %d failures: %v",
+				expected, MPV_FAILURES_BEFORE_BACKOFF+i, backoff)
+			t.Fail()
+		}
+	}
+
+	deck := &mpvDeck{name: "a", entries: map[int64]*mpvEntry{}}
+	if err := p._ensureMpv(deck); err == nil || deck.mpv != nil {
+		t.Log("mpv was started during the backoff")
+		t.Fail()
+	}
+}
+
+func TestInvalidRanking(t *testing.T) {
+	wrms := NewWrms("test", Config{Ranking: "bogus"}, func(*Wrms) Player { return &mockPlayer{} })
+	if wrms.Config.Ranking != DEFAULT_RANKING {
+		t.Logf("The ranking %s announced to the clients is not used", wrms.Config.Ranking)
+		t.Fail()
+	}
+}
+
+func TestTimeBonusMode(t *testing.T) {
+	newPlayer := func(*Wrms) Player { return &mockPlayer{} }
+
+	// The mode is kept even if no bonus is granted
+	wrms := NewWrms("test", Config{TimeBonusMode: TIME_BONUS_CONTINUOUS}, newPlayer)
+	if wrms.timeBonusMode() != TIME_BONUS_CONTINUOUS {
+		t.Logf("The valid time bonus mode was replaced by %s", wrms.timeBonusMode())
+		t.Fail()
+	}
+
+	wrms = NewWrms("test", Config{TimeBonus: 1, TimeBonusMode: "bogus"}, newPlayer)
+	if wrms.timeBonusMode() != TIME_BONUS_ON_ADD {
+		t.Log("The unknown time bonus mode was kept")
+		t.Fail()
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"muhq.space/go/wrms/llog"
 	"os/exec"
@@ -10,21 +12,71 @@ import (
 
 type YoutubeBackend struct {
 	searchResults int
+	// Stream urls resolved while the videos wait at the top of the queue
+	resolved *prefetchCache[string]
 }
 
 func NewYoutubeBackend() *YoutubeBackend {
-	return &YoutubeBackend{10}
+	return &YoutubeBackend{10, newPrefetchCache[string](nil)}
 }
 
 func (_ *YoutubeBackend) OnSongFinished(*Song) {}
 
-func (_ *YoutubeBackend) Play(song *Song, player Player) {
-	player.PlayUri("https://youtube.com/watch?v=" + song.Uri)
+func videoUrl(song *Song) string {
+	return "https://youtube.com/watch?v=" + song.Uri
+}
+
+func (b *YoutubeBackend) Play(song *Song, player Player) error {
+	if streamUrl, ok := b.resolved.Take(song); ok {
+		player.PlayUri(streamUrl)
+		return nil
+	}
+
+	player.PlayUri(videoUrl(song))
+	return nil
+}
+
+// Resolve the audio stream of the video in advance instead of letting mpv resolve it
+func (b *YoutubeBackend) Prefetch(song *Song) {
+	b.resolved.Start(song, func(ctx context.Context) (string, error) {
+		out, err := exec.CommandContext(ctx, "yt-dlp", "-g", "-f", "bestaudio", videoUrl(song)).Output()
+		if err != nil {
+			return "", fmt.Errorf("resolving the stream url failed: %w", err)
+		}
+
+		streamUrl, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if streamUrl == "" {
+			return "", errors.New("yt-dlp returned no stream url")
+		}
+		return streamUrl, nil
+	})
+}
+
+func (b *YoutubeBackend) Discard(song *Song) {
+	b.resolved.Discard(song)
+}
+
+func (b *YoutubeBackend) Duration(song *Song) (float64, error) {
+	out, err := exec.Command("yt-dlp", "-j", "--skip-download", videoUrl(song)).Output()
+	if err != nil {
+		return 0, fmt.Errorf("yt-dlp failed: %w", err)
+	}
+
+	result := YoutubeDlSearchResult{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, err
+	}
+	return result.Duration, nil
 }
 
 type YoutubeDlSearchResult struct {
 	Id    string
 	Title string
+	// Only available for music videos
+	Track  string
+	Artist string
+	// In seconds
+	Duration float64
 }
 
 func (b *YoutubeBackend) Search(patterns map[string]string) []*Song {
@@ -53,7 +105,15 @@ func (b *YoutubeBackend) Search(patterns map[string]string) []*Song {
 			llog.Debug("Parsing youtube-dl results '%s' failed", l)
 			llog.Error("Parsing youtube-dl results failed with: %s", err)
 		}
-		songs = append(songs, NewSong(result.Title, "", "youtube", result.Id))
+
+		var s *Song
+		if result.Track != "" {
+			s = NewSong(result.Track, result.Artist, "youtube", result.Id)
+		} else {
+			s = NewSong(result.Title, "", "youtube", result.Id)
+		}
+		s.Duration = result.Duration
+		songs = append(songs, s)
 	}
 
 	llog.Debug("youtube found %d matching videos", len(songs))